@@ -10,6 +10,7 @@ package dbm
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -2899,3 +2901,338 @@ func TestIsMem(t *testing.T) {
 		return
 	}
 }
+
+func TestCompact(t *testing.T) {
+	const N = 500
+
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// Random, incompressible values, so the test does not depend on
+	// compress.
+	rng := rand.New(rand.NewSource(42))
+	rnd := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.Int())
+		}
+		return b
+	}
+
+	for i := 0; i < N; i++ {
+		if err = db.Set(rnd(800), "a", i); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%10 == 0 {
+			if err = db.Set(i, "b", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	f, err := db.File("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fv := rnd(5000)
+	if _, err = f.WriteAt(fv, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Clear("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.Array("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	en, err := b.Enumerator(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N/20; i++ {
+		if _, _, err = en.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var st lldb.AllocStats
+	if err = db.Verify(nil, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The budget allows to move any single block, but not all of them in
+	// one call.
+	var budget int64
+	for atoms := range st.AllocMap {
+		if 16*atoms > budget {
+			budget = 16 * atoms
+		}
+	}
+	free := 16 * st.FreeAtoms
+	var calls int
+	for i := 0; i < 20; i++ {
+		n, err := db.Compact(context.Background(), budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 0 {
+			calls++
+		}
+	}
+
+	sz, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("size %d -> %d in %d calls, free %d", sz0, sz, calls, free)
+	if calls < 2 {
+		t.Fatal(calls)
+	}
+
+	if g, e := sz0-sz, 9*free/10; g < e {
+		t.Fatalf("reclaimed %d of %d free bytes", g, free)
+	}
+
+	if err = db.Verify(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i++ {
+		g, err := db.Get("a", i)
+		if err != nil || g != nil {
+			t.Fatal(i, g, err)
+		}
+
+		if i%10 == 0 {
+			if g, err = b.Get(i); err != nil || g != int64(i) {
+				t.Fatal(i, g, err)
+			}
+		}
+	}
+
+	g := make([]byte, len(fv))
+	if n, err := f.ReadAt(g, 0); n != len(fv) || !bytes.Equal(g, fv) {
+		t.Fatal(n, err)
+	}
+
+	// The enumerator continues after the compaction.
+	for i := N / 2; i < N; i += 10 {
+		k, v, err := en.Next()
+		if err != nil || len(k) != 1 || k[0] != int64(i) || len(v) != 1 || v[0] != int64(i) {
+			t.Fatal(i, k, v, err)
+		}
+	}
+}
+
+func TestVerifyTrees(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < 2000; i++ {
+		if err = db.Set(i, "a", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := db.File("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteAt([]byte("verify"), 1e6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Verify(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.alloc.Get(nil, a.tree.Handle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ph := b2h(r)
+	p, err := db.alloc.Get(nil, ph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p[0] = 42 // Invalid page tag.
+	if err = db.alloc.Realloc(ph, p); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []error
+	if err = db.Verify(func(err error) bool {
+		logged = append(logged, err)
+		return true
+	}, nil); err == nil || len(logged) != 1 {
+		t.Fatal(err, logged)
+	}
+
+	if e, ok := logged[0].(*lldb.ErrILSEQ); !ok || e.Type != lldb.ErrBTree {
+		t.Fatal(logged[0])
+	}
+}
+
+func TestCollation(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err = db.Set(1, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []int64{1, a.tree.Handle()} {
+		if _, err = lldb.OpenBTree(db.alloc, collate, h); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = lldb.OpenBTree(db.alloc, nil, h)
+		if e, ok := err.(*lldb.ErrCollation); !ok || e.Tree != "dbm" {
+			t.Fatalf("%T %v", err, err)
+		}
+	}
+}
+
+func TestConcurrentReaders(t *testing.T) {
+	const (
+		N       = 1000
+		readers = 8
+	)
+
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < N; i++ {
+		if err = db.Set(i, "a", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Readers do not exclude each other.
+	if err = db.enterRead(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := db.Get("a", 0)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reader blocked by another reader")
+	}
+	db.leaveRead()
+
+	a, err := db.Array("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers+1)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+
+			for i := r; i < N; i += readers {
+				v, err := db.Get("a", i)
+				if err == nil && v != int64(i) {
+					err = fmt.Errorf("db.Get(%d): %v", i, v)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				// a is shared by all the readers.
+				if v, err = a.Get(i); err == nil && v != int64(i) {
+					err = fmt.Errorf("a.Get(%d): %v", i, v)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < N; i++ {
+			if err := db.Set(i, "b", i); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err = db.Verify(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
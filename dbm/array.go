@@ -7,6 +7,7 @@ package dbm
 import (
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/cznic/exp/lldb"
 )
@@ -214,7 +215,7 @@ func (a *Array) inc(delta int64, subscripts ...interface{}) (val int64, err erro
 // Get returns the value at subscripts in subtree 'a', or nil if no such value
 // exists.
 func (a *Array) Get(subscripts ...interface{}) (value interface{}, err error) {
-	if err = a.db.enter(); err != nil {
+	if err = a.db.enterRead(); err != nil {
 		return
 	}
 
@@ -222,20 +223,21 @@ func (a *Array) Get(subscripts ...interface{}) (value interface{}, err error) {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		a.db.leave(&err)
+		a.db.leaveRead()
 	}()
 
-	if ok, e := a.validate(false); !ok || err != nil {
+	r := *a // validate sets r.tree, a may be shared by other readers.
+	if ok, e := r.validate(false); !ok || err != nil {
 		err = e
 		return
 	}
 
-	value, err = a.get(subscripts...)
+	value, err = r.get(subscripts...)
 	if value == nil {
 		return
 	}
 
-	if t := a.tree; t != nil && !t.IsMem() && t.Handle() == 1 {
+	if t := r.tree; t != nil && !t.IsMem() && t.Handle() == 1 {
 		value = 0
 	}
 	return
@@ -379,7 +381,7 @@ func (a *Array) Clear(subscripts ...interface{}) (err error) {
 // If from is nil it works as 'from lowest existing key'.  If to is nil it
 // works as 'to highest existing key'.
 func (a *Array) Slice(from, to []interface{}) (s *Slice, err error) {
-	if err = a.db.enter(); err != nil {
+	if err = a.db.enterRead(); err != nil {
 		return
 	}
 
@@ -387,7 +389,7 @@ func (a *Array) Slice(from, to []interface{}) (s *Slice, err error) {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		a.db.leave(&err)
+		a.db.leaveRead()
 	}()
 
 	prefix, err := lldb.DecodeScalars(a.prefix)
@@ -439,7 +441,7 @@ func (a *Array) Tree() (tr *lldb.BTree, err error) {
 //
 // This method is safe for concurrent use by multiple goroutines.
 func (a *Array) Enumerator(asc bool) (en *Enumerator, err error) {
-	if err = a.db.enter(); err != nil {
+	if err = a.db.enterRead(); err != nil {
 		return
 	}
 
@@ -452,7 +454,7 @@ func (a *Array) Enumerator(asc bool) (en *Enumerator, err error) {
 				err = fmt.Errorf("%v", e)
 			}
 		}
-		a.db.leave(&err)
+		a.db.leaveRead()
 	}()
 
 	var e Enumerator
@@ -474,6 +476,7 @@ func (a *Array) Enumerator(asc bool) (en *Enumerator, err error) {
 type Enumerator struct {
 	db *DB
 	en *lldb.BTreeEnumerator
+	mu sync.Mutex // Readers share db, en is used by one of them at a time.
 }
 
 // Next returns the currently enumerated raw KV pair, if it exists and moves to
@@ -482,10 +485,13 @@ type Enumerator struct {
 //
 // This method is safe for concurrent use by multiple goroutines.
 func (e *Enumerator) Next() (key, value []interface{}, err error) {
-	if err = e.db.enter(); err != nil {
+	if err = e.db.enterRead(); err != nil {
 		return
 	}
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	defer func() {
 		if e := recover(); e != nil {
 			switch x := e.(type) {
@@ -495,7 +501,7 @@ func (e *Enumerator) Next() (key, value []interface{}, err error) {
 				err = fmt.Errorf("%v", e)
 			}
 		}
-		e.db.leave(&err)
+		e.db.leaveRead()
 	}()
 
 	k, v, err := e.en.Next()
@@ -517,10 +523,13 @@ func (e *Enumerator) Next() (key, value []interface{}, err error) {
 //
 // This method is safe for concurrent use by multiple goroutines.
 func (e *Enumerator) Prev() (key, value []interface{}, err error) {
-	if err = e.db.enter(); err != nil {
+	if err = e.db.enterRead(); err != nil {
 		return
 	}
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	defer func() {
 		if e := recover(); e != nil {
 			switch x := e.(type) {
@@ -530,7 +539,7 @@ func (e *Enumerator) Prev() (key, value []interface{}, err error) {
 				err = fmt.Errorf("%v", e)
 			}
 		}
-		e.db.leave(&err)
+		e.db.leaveRead()
 	}()
 
 	k, v, err := e.en.Prev()
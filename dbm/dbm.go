@@ -15,6 +15,7 @@ package dbm
 //	to bee a too different API then. (package udbm?)
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
@@ -69,7 +70,8 @@ type DB struct {
 	acidState     int             // Grace period FSM state.
 	acidTimer     *time.Timer     // Grace period timer
 	alloc         *lldb.Allocator // The machinery. Wraps filer
-	bkl           sync.Mutex      // Big Kernel Lock
+	bkl           sync.RWMutex    // Big Kernel Lock, shared by the readers
+	cacheMu       sync.Mutex      // Guards _root and the tree caches
 	closeMu       sync.Mutex      // Close() coordination
 	closed        chan bool
 	emptySize     int64         // Any header size including FLT.
@@ -333,6 +335,9 @@ func (db *DB) close() (err error) {
 }
 
 func (db *DB) root() (r *Array, err error) {
+	db.cacheMu.Lock()
+	defer db.cacheMu.Unlock()
+
 	if r = db._root; r != nil {
 		return
 	}
@@ -440,7 +445,7 @@ func (db *DB) Set(value interface{}, array string, subscripts ...interface{}) (e
 // Get returns the value at subscripts in array, or nil if no such value
 // exists.
 func (db *DB) Get(array string, subscripts ...interface{}) (value interface{}, err error) {
-	if err = db.enter(); err != nil {
+	if err = db.enterRead(); err != nil {
 		return
 	}
 
@@ -448,7 +453,7 @@ func (db *DB) Get(array string, subscripts ...interface{}) (value interface{}, e
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		db.leave(&err)
+		db.leaveRead()
 	}()
 
 	a, err := db.array_(false, array, subscripts...)
@@ -463,7 +468,7 @@ func (db *DB) Get(array string, subscripts ...interface{}) (value interface{}, e
 // If from is nil it works as 'from lowest existing key'.  If to is nil it
 // works as 'to highest existing key'.
 func (db *DB) Slice(array string, subscripts, from, to []interface{}) (s *Slice, err error) {
-	if err = db.enter(); err != nil {
+	if err = db.enterRead(); err != nil {
 		return
 	}
 
@@ -471,7 +476,7 @@ func (db *DB) Slice(array string, subscripts, from, to []interface{}) (s *Slice,
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		db.leave(&err)
+		db.leaveRead()
 	}()
 
 	a, err := db.array_(false, array, subscripts...)
@@ -553,6 +558,169 @@ func (db *DB) Size() (sz int64, err error) {
 	return db.filer.Size()
 }
 
+// Compact attempts to reduce the size of the DB file by moving data from its
+// end to the free space nearer to its start. Moving stops when ctx is done or
+// before the amount of moved data would exceed budget bytes. A negative budget
+// means no limit. Compact returns the number of bytes by which the DB file
+// size was reduced. A Compact which ran out of budget may not have reduced the
+// size yet, but the next one continues where it stopped. See also
+// lldb.Allocator.CompactRehandle.
+//
+// Compact gives the moved data new handles and updates the references to them
+// held in the DB, so it can reclaim nearly all of the free space. Arrays,
+// Files and enumerators stay valid.
+//
+// With ACIDTransactions or ACIDFull all moves made by one Compact call are a
+// single transaction held in memory until committed. Use a budget to keep the
+// transaction reasonably sized and call Compact repeatedly. If Compact fails,
+// including when ctx is done, the transaction is rolled back.
+func (db *DB) Compact(ctx context.Context, budget int64) (reclaimed int64, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	sz, err := db.filer.Size()
+	if sz <= db.emptySize || err != nil {
+		return
+	}
+
+	// The root directory and the trees being removed, which are held open
+	// by their victors, keep their handles.
+	fixed := map[int64]bool{1: true}
+	if err = db.removes(func(h int64) error { fixed[h] = true; return nil }); err != nil {
+		return
+	}
+
+	reclaimed, moved, err := db.alloc.CompactRehandle(ctx, budget, func(h int64) bool { return !fixed[h] })
+	switch {
+	case err != nil && db.xact:
+		return 0, err // Rolled back by leave.
+	case len(moved) != 0:
+		if e := db.rehandle(moved); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// rehandle updates the trees of the DB, the root directory and the cached
+// trees after db.alloc.CompactRehandle moved some of their blocks.
+func (db *DB) rehandle(moved map[int64]int64) (err error) {
+	done := map[int64]bool{}
+	for _, c := range []treeCache{db.acache, db.fcache, db.scache} {
+		for _, t := range c {
+			if h := t.Handle(); !done[h] {
+				if err = t.Rehandle(moved); err != nil {
+					return
+				}
+
+				done[h] = true
+			}
+		}
+	}
+
+	root, err := db.root()
+	if err != nil {
+		return
+	}
+
+	if err = root.tree.Rehandle(moved); err != nil {
+		return
+	}
+
+	// The root directory maps the names of the trees to their handles.
+	type item struct {
+		k []byte
+		h int64
+	}
+	var items []item
+	if err = handles(root.tree, false, func(k []byte, h int64) error {
+		items = append(items, item{k, h})
+		return nil
+	}); err != nil {
+		return
+	}
+
+	for _, it := range items {
+		if !done[it.h] {
+			if _, err = lldb.RehandleBTree(db.alloc, it.h, moved); err != nil {
+				return
+			}
+
+			done[it.h] = true
+		}
+
+		if h, ok := moved[it.h]; ok {
+			v, err := lldb.EncodeScalars(h)
+			if err != nil {
+				return err
+			}
+
+			if err = root.tree.Set(it.k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return db.removes(func(h int64) (err error) {
+		if !done[h] {
+			_, err = lldb.RehandleBTree(db.alloc, h, moved)
+		}
+		return
+	})
+}
+
+// removes calls f for the handles of the trees being removed.
+func (db *DB) removes(f func(h int64) error) (err error) {
+	removes, err := db.sysArray(false, rname)
+	if removes.tree == nil || err != nil {
+		return
+	}
+
+	return handles(removes.tree, true, func(_ []byte, h int64) error { return f(h) })
+}
+
+// handles calls f for the KV pairs of t having a single int64 as their value
+// or, if keys is true, as their key.
+func handles(t *lldb.BTree, keys bool, f func(k []byte, h int64) error) (err error) {
+	en, err := t.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	for {
+		k, v, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		if keys {
+			v = k
+		}
+		d, err := lldb.DecodeScalars(v)
+		if err != nil {
+			return err
+		}
+
+		if len(d) != 1 {
+			continue
+		}
+
+		if h, ok := d[0].(int64); ok {
+			if err = f(k, h); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (db *DB) setRemoving(h int64, flag bool) (r bool) {
 	db.removingMu.Lock()
 	defer db.removingMu.Unlock()
@@ -931,6 +1099,23 @@ func (db *DB) leave(err *error) error {
 	return *err
 }
 
+// enterRead is enter for the methods which only read the DB. Readers hold bkl
+// shared, so they run concurrently with each other, but not with the methods
+// using enter. Readers do not begin any updates of the DB's Filer.
+func (db *DB) enterRead() (err error) {
+	db.bkl.RLock()
+	if db.acidState == stEndUpdateFailed {
+		db.bkl.RUnlock()
+		return fmt.Errorf("Last transaction commit failed: %v", db.lastCommitErr)
+	}
+
+	return
+}
+
+func (db *DB) leaveRead() {
+	db.bkl.RUnlock()
+}
+
 func (db *DB) timeout() {
 	db.bkl.Lock()
 	defer db.bkl.Unlock()
@@ -1104,6 +1289,9 @@ func (db *DB) Rollback() (err error) {
 // free space, then a 4th scan (a faster one) is performed to precisely report
 // all of them.
 //
+// If the allocator level verification succeeds, the BTrees of the root
+// directory and of every array and file are checked using lldb.BTree.Verify.
+//
 // Statistics are returned via 'stats' if non nil. The statistics are valid
 // only if Verify succeeded, ie. it didn't reported anything to log and it
 // returned a nil error.
@@ -1132,7 +1320,62 @@ func (db *DB) Verify(log func(error) bool, stats *lldb.AllocStats) (err error) {
 		db.leave(&err)
 	}()
 
-	return db.alloc.Verify(bitmap, log, stats)
+	if err = db.alloc.Verify(bitmap, log, stats); err != nil {
+		return
+	}
+
+	return db.verifyTrees(log)
+}
+
+func (db *DB) verifyTrees(log func(error) bool) (err error) {
+	sz, err := db.filer.Size()
+	if sz <= db.emptySize || err != nil {
+		return
+	}
+
+	root, err := db.root()
+	if err != nil {
+		return
+	}
+
+	if _, err = root.tree.Verify(log); err != nil {
+		return
+	}
+
+	en, err := root.tree.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	for {
+		_, v, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		d, err := lldb.DecodeScalars(v)
+		if err != nil {
+			return err
+		}
+
+		if len(d) != 1 {
+			continue
+		}
+
+		h, ok := d[0].(int64)
+		if !ok {
+			continue
+		}
+
+		t, err := lldb.OpenBTree(db.alloc, collate, h)
+		if err != nil {
+			return err
+		}
+
+		if _, err = t.Verify(log); err != nil {
+			return err
+		}
+	}
 }
 
 // PeakWALSize reports the maximum size WAL has ever used.
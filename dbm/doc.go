@@ -45,6 +45,11 @@ within a structural transaction may corrupt the DB.
 Also please note that passing racy arguments to an otherwise concurrent safe
 API makes that API act racy as well.
 
+The methods only reading a DB, ie. the Get and Slice methods of DB and
+Array, Slice.Do, Array.Enumerator, the Next and Prev methods of Enumerator and
+the File methods Size and ReadAt, run concurrently with each other. Any other
+method waits for the readers to finish and excludes them while it runs.
+
 Scalars
 
 Keys and values of an Array are multi-valued and every value must be a
@@ -69,6 +69,14 @@ func collate(a, b []byte) (r int) {
 	return
 }
 
+// The trees of a DB record the name of collate, see lldb.CreateBTree, so they
+// cannot be opened by lldb.OpenBTree using another collation.
+func init() {
+	if err := lldb.RegisterCollation("dbm", collate); err != nil {
+		panic(err)
+	}
+}
+
 type treeCache map[string]*lldb.BTree
 
 func (t *treeCache) get() (r map[string]*lldb.BTree) {
@@ -80,13 +88,25 @@ func (t *treeCache) get() (r map[string]*lldb.BTree) {
 	return *t
 }
 
+// getTree returns the tree name, opening it if it's not cached. The readers of
+// a DB, see DB.enterRead, invoke getTree concurrently, they never create a
+// tree.
 func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cacheSize int) (r *lldb.BTree, err error) {
-	m := t.get()
-	r, ok := m[name]
+	db.cacheMu.Lock()
+	r, ok := t.get()[name]
+	db.cacheMu.Unlock()
 	if ok {
 		return
 	}
 
+	if !canCreate {
+		// Do not create the root directory of an empty DB.
+		sz, err := db.filer.Size()
+		if sz <= db.emptySize || err != nil {
+			return nil, err
+		}
+	}
+
 	root, err := db.root()
 	if err != nil {
 		return
@@ -120,6 +140,14 @@ func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cac
 		return nil, &lldb.ErrINVAL{Src: "corrupted root directory value for", Val: fmt.Sprintf("%q, %q", prefix, name)}
 	}
 
+	db.cacheMu.Lock()
+	defer db.cacheMu.Unlock()
+
+	m := t.get()
+	if r0, ok := m[name]; ok { // Opened meanwhile by another reader.
+		return r0, nil
+	}
+
 	if len(m) > cacheSize {
 		i, j, n := 0, cacheSize/2, mathutil.Min(cacheSize/20, 10)
 	loop:
@@ -124,7 +124,7 @@ func (f *File) Name() string {
 
 // As os.File.FileInfo().Size().
 func (f *File) Size() (sz int64, err error) {
-	if err = f.db.enter(); err != nil {
+	if err = f.db.enterRead(); err != nil {
 		return
 	}
 
@@ -132,14 +132,15 @@ func (f *File) Size() (sz int64, err error) {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		f.db.leave(&err)
+		f.db.leaveRead()
 	}()
 
-	if ok, err := (*Array)(f).validate(false); !ok {
+	g := *f // validate sets g.tree, f may be shared by other readers.
+	if ok, err := (*Array)(&g).validate(false); !ok {
 		return 0, err
 	}
 
-	return f.size()
+	return g.size()
 }
 
 func (f *File) size() (sz int64, err error) {
@@ -22,6 +22,10 @@ type Slice struct {
 // read error).  If f returns false or a non nil error then Do terminates and
 // returns the value of error from f.
 //
+// f may set or delete items of the array, including the one it was called
+// with. The enumeration then continues with the subscripts collating after
+// those f was last called with.
+//
 // Note: f can get called with a subscripts-value pair which actually may no
 // longer exist - if some other goroutine introduces such data race.
 // Coordination required to avoid this situation, if applicable/desirable, must
@@ -32,23 +36,24 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 		noVal bool
 	)
 
-	if err = db.enter(); err != nil {
+	if err = db.enterRead(); err != nil {
 		return
 	}
 
 	doLeave := true
 	defer func() {
 		if doLeave {
-			db.leave(&err)
+			db.leaveRead()
 		}
 	}()
 
-	ok, err := s.a.validate(false)
+	a := *s.a // validate sets a.tree, s may be shared by other readers.
+	ok, err := a.validate(false)
 	if !ok {
 		return err
 	}
 
-	tree := s.a.tree
+	tree := a.tree
 	if !tree.IsMem() && tree.Handle() == 1 {
 		noVal = true
 	}
@@ -97,9 +102,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 			}
 
 			doLeave = false
-			if db.leave(&err) != nil {
-				return err
-			}
+			db.leaveRead()
 
 			if noVal && v != nil {
 				v = []interface{}{0}
@@ -108,7 +111,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return noEof(err)
 			}
 
-			if err = db.enter(); err != nil {
+			if err = db.enterRead(); err != nil {
 				return err
 			}
 
@@ -152,9 +155,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 			}
 
 			doLeave = false
-			if db.leave(&err) != nil {
-				return err
-			}
+			db.leaveRead()
 
 			if noVal && v != nil {
 				v = []interface{}{0}
@@ -163,7 +164,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return noEof(err)
 			}
 
-			if err = db.enter(); err != nil {
+			if err = db.enterRead(); err != nil {
 				return err
 			}
 
@@ -212,9 +213,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 			}
 
 			doLeave = false
-			if db.leave(&err) != nil {
-				return err
-			}
+			db.leaveRead()
 
 			if noVal && v != nil {
 				v = []interface{}{0}
@@ -223,7 +222,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return noEof(err)
 			}
 
-			if err = db.enter(); err != nil {
+			if err = db.enterRead(); err != nil {
 				return err
 			}
 
@@ -267,9 +266,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 			}
 
 			doLeave = false
-			if db.leave(&err) != nil {
-				return err
-			}
+			db.leaveRead()
 
 			if noVal && v != nil {
 				v = []interface{}{0}
@@ -278,7 +275,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return noEof(err)
 			}
 
-			if err = db.enter(); err != nil {
+			if err = db.enterRead(); err != nil {
 				return err
 			}
 
@@ -11,7 +11,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/cznic/fileutil"
 	"github.com/cznic/mathutil"
@@ -96,10 +95,11 @@ const (
 //  [1]: http://godoc.org/github.com/cznic/exp/dbm
 type ACIDFiler0 struct {
 	*RollbackFiler
-	wal               *os.File
+	wal               OSFile
 	bwal              *bufio.Writer
 	data              []acidWrite
 	testHook          bool  // keeps WAL untruncated (once)
+	wipe              bool  // zero the WAL before truncating it
 	peakWal           int64 // tracks WAL maximum used size
 	peakBitFilerPages int   // track maximum transaction memory
 }
@@ -114,7 +114,10 @@ type ACIDFiler0 struct {
 // transaction exists it's committed to db. If the recovery process finishes
 // successfully, the WAL is truncated to zero size and fsync'ed prior to return
 // from NewACIDFiler0.
-func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
+//
+// The WAL is usually an *os.File. Any other OSFile, like eg. an
+// EncryptedFiler, can be used as well.
+func NewACIDFiler(db Filer, wal OSFile) (r *ACIDFiler0, err error) {
 	fi, err := wal.Stat()
 	if err != nil {
 		return
@@ -174,18 +177,12 @@ func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
 
 			// Phase 2 commit complete
 
-			if !r.testHook {
-				if err = r.wal.Truncate(0); err != nil {
-					return
-				}
-
-				if _, err = r.wal.Seek(0, 0); err != nil {
-					return
-				}
+			if r.testHook {
+				r.testHook = false
+				return r.wal.Sync()
 			}
 
-			r.testHook = false
-			return r.wal.Sync()
+			return r.resetWAL()
 
 		},
 		acidWriter,
@@ -219,6 +216,52 @@ func (a *ACIDFiler0) readPacket(f *bufio.Reader) (items []interface{}, err error
 	return DecodeScalars(b[:ln])
 }
 
+// isTorn reports whether err means the WAL ends before the checkpoint packet,
+// ie. the crash occurred before the transaction was committed.
+func (a *ACIDFiler0) isTorn(err error) bool {
+	return fileutil.IsEOF(err) || err == io.ErrUnexpectedEOF
+}
+
+// resetWAL truncates the WAL to zero size, ie. it drops the uncommitted
+// transaction or the transaction already reflected in the DB. If wiping is
+// enabled, the WAL content is overwritten with zeros first.
+func (a *ACIDFiler0) resetWAL() (err error) {
+	if a.wipe {
+		if err = a.zeroWAL(); err != nil {
+			return
+		}
+	}
+
+	if err = a.wal.Truncate(0); err != nil {
+		return
+	}
+
+	if _, err = a.wal.Seek(0, 0); err != nil {
+		return
+	}
+
+	return a.wal.Sync()
+}
+
+// zeroWAL overwrites the WAL content with zeros and syncs it, so the
+// truncation of the WAL releases only zeroed storage.
+func (a *ACIDFiler0) zeroWAL() (err error) {
+	fi, err := a.wal.Stat()
+	if err != nil {
+		return
+	}
+
+	var b [1 << 12]byte
+	for off, sz := int64(0), fi.Size(); off < sz; off += int64(len(b)) {
+		n := int(mathutil.MinInt64(int64(len(b)), sz-off))
+		if _, err = a.wal.WriteAt(b[:n], off); err != nil {
+			return
+		}
+	}
+
+	return a.wal.Sync()
+}
+
 func (a *ACIDFiler0) recoverDb(db Filer) (err error) {
 	fi, err := a.wal.Stat()
 	if err != nil {
@@ -232,6 +275,10 @@ func (a *ACIDFiler0) recoverDb(db Filer) (err error) {
 	f := bufio.NewReader(a.wal)
 	items, err := a.readPacket(f)
 	if err != nil {
+		if a.isTorn(err) {
+			return a.resetWAL()
+		}
+
 		return
 	}
 
@@ -244,6 +291,10 @@ func (a *ACIDFiler0) recoverDb(db Filer) (err error) {
 	for {
 		items, err = a.readPacket(f)
 		if err != nil {
+			if a.isTorn(err) {
+				return a.resetWAL()
+			}
+
 			return
 		}
 
@@ -312,11 +363,7 @@ func (a *ACIDFiler0) recoverDb(db Filer) (err error) {
 
 			// Recovery complete
 
-			if err = a.wal.Truncate(0); err != nil {
-				return err
-			}
-
-			return a.wal.Sync()
+			return a.resetWAL()
 		default:
 			return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("packet tag %v", items[0])}
 		}
@@ -35,12 +35,23 @@ func (f *truncFiler) BeginUpdate() error                      { panic("internal
 func (f *truncFiler) Close() error                            { return f.f.Close() }
 func (f *truncFiler) EndUpdate() error                        { panic("internal error") }
 func (f *truncFiler) Name() string                            { return f.f.Name() }
-func (f *truncFiler) PunchHole(off, sz int64) error           { panic("internal error") }
 func (f *truncFiler) ReadAt(b []byte, off int64) (int, error) { return f.fake.ReadAt(b, off) }
 func (f *truncFiler) Rollback() error                         { panic("internal error") }
 func (f *truncFiler) Size() (int64, error)                    { return f.fake.Size() }
 func (f *truncFiler) Sync() error                             { return f.f.Sync() }
 
+func (f *truncFiler) PunchHole(off, sz int64) error {
+	if err := f.fake.PunchHole(off, sz); err != nil {
+		return err
+	}
+
+	if lim := f.limit; lim >= 0 && f.totalWritten >= lim {
+		return nil
+	}
+
+	return f.f.PunchHole(off, sz)
+}
+
 func (f *truncFiler) Truncate(sz int64) error {
 	f.fake.Truncate(sz)
 	return f.f.Truncate(sz)
@@ -283,3 +294,379 @@ func TestACIDFiler0(t *testing.T) {
 		return
 	}
 }
+
+// crashOp is a recorded update of the DB or the WAL of an ACIDFiler0.
+type crashOp struct {
+	wal  bool
+	kind byte  // 'w': WriteAt, 's': Sync, 't': Truncate
+	off  int64 // WriteAt offset or Truncate size
+	b    []byte
+}
+
+type crashLog struct {
+	ops []crashOp
+}
+
+func (l *crashLog) add(wal bool, kind byte, off int64, b []byte) {
+	if l == nil { // Not recording.
+		return
+	}
+
+	l.ops = append(l.ops, crashOp{wal, kind, off, append([]byte(nil), b...)})
+}
+
+// replay applies the first n recorded updates to db and wal. If lost is set,
+// updates not followed by a Sync of the same file are skipped, simulating
+// a power loss discarding the OS write back caches.
+func (l *crashLog) replay(db, wal Filer, n int, lost bool) (err error) {
+	ops := l.ops[:n]
+	synced := map[bool]int{false: -1, true: -1}
+	if lost {
+		for i, v := range ops {
+			if v.kind == 's' {
+				synced[v.wal] = i
+			}
+		}
+	}
+	for i, v := range ops {
+		if lost && i > synced[v.wal] {
+			continue
+		}
+
+		f := db
+		if v.wal {
+			f = wal
+		}
+		switch v.kind {
+		case 'w':
+			_, err = f.WriteAt(v.b, v.off)
+		case 't':
+			err = f.Truncate(v.off)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// crashDB is a Filer recording the updates of an ACIDFiler0 DB. Nothing is
+// recorded while log is nil.
+type crashDB struct {
+	*MemFiler
+	log *crashLog
+}
+
+func (f *crashDB) Sync() error {
+	f.log.add(false, 's', 0, nil)
+	return f.MemFiler.Sync()
+}
+
+func (f *crashDB) Truncate(sz int64) error {
+	f.log.add(false, 't', sz, nil)
+	return f.MemFiler.Truncate(sz)
+}
+
+func (f *crashDB) WriteAt(b []byte, off int64) (int, error) {
+	f.log.add(false, 'w', off, b)
+	return f.MemFiler.WriteAt(b, off)
+}
+
+// crashWAL is an in memory OSFile recording the updates of an ACIDFiler0 WAL.
+type crashWAL struct {
+	*MemFiler
+	log *crashLog
+	pos int64
+}
+
+func (f *crashWAL) Read(b []byte) (n int, err error) {
+	n, err = f.ReadAt(b, f.pos)
+	f.pos += int64(n)
+	if n != 0 {
+		err = nil
+	}
+	return
+}
+
+func (f *crashWAL) Seek(off int64, whence int) (int64, error) {
+	if whence != 0 {
+		panic("internal error")
+	}
+
+	f.pos = off
+	return off, nil
+}
+
+func (f *crashWAL) Stat() (os.FileInfo, error) {
+	sz, _ := f.Size()
+	return filerFileInfo{f.Name(), sz}, nil
+}
+
+func (f *crashWAL) Sync() error {
+	f.log.add(true, 's', 0, nil)
+	return f.MemFiler.Sync()
+}
+
+func (f *crashWAL) Truncate(sz int64) error {
+	f.log.add(true, 't', sz, nil)
+	return f.MemFiler.Truncate(sz)
+}
+
+func (f *crashWAL) Write(b []byte) (n int, err error) {
+	n, err = f.WriteAt(b, f.pos)
+	f.pos += int64(n)
+	return
+}
+
+func (f *crashWAL) WriteAt(b []byte, off int64) (int, error) {
+	f.log.add(true, 'w', off, b)
+	return f.MemFiler.WriteAt(b, off)
+}
+
+func newCrashFiler(db, wal []byte) (*MemFiler, *crashWAL) {
+	mdb, mwal := NewMemFiler(), NewMemFiler()
+	if _, err := mdb.WriteAt(db, 0); err != nil {
+		panic(err)
+	}
+
+	if _, err := mwal.WriteAt(wal, 0); err != nil {
+		panic(err)
+	}
+
+	return mdb, &crashWAL{MemFiler: mwal}
+}
+
+// testACIDCrash runs update in a transaction of f while recording all the
+// updates of its DB and WAL. Then, for every prefix of the recorded history,
+// it simulates a crash at that point and checks that the recovery of the DB
+// by NewACIDFiler produces either the DB content before or after update and
+// that the recovered DB passes Allocator.Verify.
+func testACIDCrash(t *testing.T, f *ACIDFiler0, db *crashDB, wal *crashWAL, update func() error) {
+	oldDB, oldWAL := filerBytes(db), filerBytes(wal)
+	log := &crashLog{}
+	db.log, wal.log = log, log
+	if err := f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := update(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.log, wal.log = nil, nil
+	newDB := filerBytes(db)
+	if bytes.Equal(oldDB, newDB) {
+		t.Fatal("update did not change the DB")
+	}
+
+	for n := 0; n <= len(log.ops); n++ {
+		for _, lost := range []bool{false, true} {
+			rdb, rwal := newCrashFiler(oldDB, oldWAL)
+			if err := log.replay(rdb, rwal, n, lost); err != nil {
+				t.Fatal(n, lost, err)
+			}
+
+			rf, err := NewACIDFiler(rdb, rwal)
+			if err != nil {
+				t.Fatalf("crash at %d/%d, lost %v: %v", n, len(log.ops), lost, err)
+			}
+
+			if sz, _ := rwal.Size(); sz != 0 || rwal.pos != 0 {
+				t.Fatalf("crash at %d/%d, lost %v: WAL not reset, size %d, position %d", n, len(log.ops), lost, sz, rwal.pos)
+			}
+
+			switch g := filerBytes(rdb); {
+			case bytes.Equal(g, oldDB):
+				if n == len(log.ops) && !lost {
+					t.Fatalf("crash at %d/%d: update lost", n, len(log.ops))
+				}
+			case bytes.Equal(g, newDB):
+				// ok
+			default:
+				t.Fatalf("crash at %d/%d, lost %v: recovered DB is neither the old nor the new one", n, len(log.ops), lost)
+			}
+
+			a, err := NewAllocator(rf, &Options{})
+			if err != nil {
+				t.Fatal(n, lost, err)
+			}
+
+			if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+				t.Fatalf("crash at %d/%d, lost %v: %v", n, len(log.ops), lost, err)
+			}
+		}
+	}
+}
+
+func TestACIDFiler0Crash(t *testing.T) {
+	const N = 10
+
+	db := &crashDB{MemFiler: NewMemFiler()}
+	wal := &crashWAL{MemFiler: NewMemFiler()}
+	f, err := NewACIDFiler(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Compress = true
+	tr, _, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var k [8]byte
+	for i := 0; i < N; i++ {
+		testACIDCrash(t, f, db, wal, func() error {
+			for j := 0; j < 50; j++ {
+				binary.BigEndian.PutUint64(k[:], uint64(rng.Intn(500)))
+				if rng.Intn(3) == 0 {
+					if err := tr.Delete(k[:]); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if err := tr.Set(k[:], rndBytes(rng, rng.Intn(200))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// wipeWAL checks the WAL is zeroed whenever it is truncated.
+type wipeWAL struct {
+	*crashWAL
+	t      *testing.T
+	resets int
+}
+
+func (f *wipeWAL) Truncate(sz int64) error {
+	if sz == 0 {
+		f.resets++
+		for i, v := range filerBytes(f.MemFiler) {
+			if v != 0 {
+				f.t.Fatalf("WAL not wiped at %#x", i)
+			}
+		}
+	}
+	return f.crashWAL.Truncate(sz)
+}
+
+func TestACIDFiler0Wipe(t *testing.T) {
+	const N = 200
+
+	db := NewMemFiler()
+	wal := &wipeWAL{crashWAL: &crashWAL{MemFiler: NewMemFiler()}, t: t}
+	f, err := NewACIDFiler(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{WipeOnFree: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("secret!")
+	rng := rand.New(rand.NewSource(42))
+	content := func(max int, secrets bool) []byte {
+		b := rndBytes(rng, 1+rng.Intn(max))
+		if secrets {
+			for i := 0; i+len(secret) <= len(b); i += 100 {
+				copy(b[i:], secret)
+			}
+		}
+		return b
+	}
+
+	leaked := func() bool { return bytes.Contains(filerBytes(db), secret) }
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var hs []int64
+	for i := 0; i < N; i++ {
+		h, err := a.Alloc(content(10000, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hs = append(hs, h)
+		if _, err = a.Alloc(content(100, false)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Freed within the transaction.
+		if h, err = a.Alloc(content(1000, true)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = a.Free(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !leaked() {
+		t.Fatal("no live secrets")
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, h := range hs {
+		switch i % 3 {
+		case 0:
+			err = a.Free(h)
+		case 1: // Shrink.
+			err = a.Realloc(h, content(10, false))
+		case 2: // Relocate.
+			err = a.Realloc(h, content(20000, false))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if leaked() {
+		t.Fatal("leaked secrets")
+	}
+
+	if wal.resets != 3 { // Incl. the NewAllocator transaction.
+		t.Fatal(wal.resets)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/cznic/bufs"
 	"github.com/cznic/fileutil"
@@ -18,13 +19,18 @@ import (
 )
 
 const (
-	kData             = 256         // [1, 512]
-	kIndex            = 256         // [2, 2048]
-	kKV               = 19          // Size of the key/value field in btreeDataPage
-	kSz               = kKV - 1 - 7 // Content prefix size
-	kH                = kKV - 7     // Content field offset for handle
-	tagBTreeDataPage  = 1
-	tagBTreeIndexPage = 0
+	kData                    = 256         // [1, 512]
+	kIndex                   = 256         // [2, 2048]
+	kKV                      = 19          // Size of the key/value field in btreeDataPage
+	kSz                      = kKV - 1 - 7 // Content prefix size
+	kH                       = kKV - 7     // Content field offset for handle
+	kPrefix                  = 255         // Maximum key prefix length of a data page
+	tagBTreeDataPage         = 1
+	tagBTreeIndexPage        = 0
+	tagBTreeCountedIndexPage = 2
+	tagBTreePrefixDataPage   = 3
+
+	btreeFlagPrefix = 1 // Root block flag: new data pages are prefix compressed.
 )
 
 // BTree is a B+tree[1][2], i.e. a variant which speeds up
@@ -39,6 +45,11 @@ const (
 // io.EOF is returned only by bTreeEnumerator methods to indicate "no more K-V
 // pair".
 //
+// The methods of a BTree are safe for concurrent use by multiple goroutines.
+// The reading methods, ie. Get, First, Last, the Seek* methods and the methods
+// of the returned enumerators, run concurrently with each other. The mutating
+// methods hold the tree exclusively.
+//
 //  [1]: http://en.wikipedia.org/wiki/B+tree
 //  [2]: http://zgking.com:8080/home/donghui/publications/books/dshandbook_BTree.pdf
 //  [3]: http://people.cs.aau.dk/~simas/aalg06/UbiquitBtree.pdf
@@ -47,6 +58,7 @@ type BTree struct {
 	root    btree
 	collate func(a, b []byte) int
 	serial  uint64
+	mu      sync.RWMutex // Readers vs. mutators.
 }
 
 // NewBTree returns a new, memory-only BTree.
@@ -57,7 +69,18 @@ func NewBTree(collate func(a, b []byte) int) *BTree {
 		panic(err.Error())
 	}
 
-	return &BTree{store, root, collate, 0}
+	return &BTree{store: store, root: root, collate: collate}
+}
+
+// NewBTreeFromSorted returns a new, memory-only BTree loaded with the KV pairs
+// returned by next. See CreateBTreeFromSorted for details.
+func NewBTreeFromSorted(collate func(a, b []byte) int, next func() (k, v []byte, err error)) (*BTree, error) {
+	t := NewBTree(collate)
+	if err := t.root.load(t.store, collate, next); err != nil {
+		return nil, err
+	}
+
+	return t, nil
 }
 
 // IsMem reports if t is a memory only BTree.
@@ -73,10 +96,51 @@ func (t *BTree) Clear() (err error) {
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	return t.root.clear(t.store)
 }
 
+// Count returns the number of keys in the range [from, to). A nil from is
+// before the first key and a nil to is past the last key of the tree, ie.
+// Count(nil, nil) equals Len. See Len about the time complexity.
+//
+// Count is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
+func (t *BTree) Count(from, to []byte) (n int64, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	c := t.collate
+	if c == nil {
+		c = bytes.Compare
+	}
+	if from != nil && to != nil && c(from, to) >= 0 {
+		return
+	}
+
+	var lo int64
+	if from != nil {
+		if lo, err = t.root.rank(t.store, c, from); err != nil {
+			return
+		}
+	}
+
+	if to == nil {
+		n, err = t.root.len(t.store)
+	} else {
+		n, err = t.root.rank(t.store, c, to)
+	}
+	return n - lo, err
+}
+
 // Delete deletes key and its associated value from the tree.
 func (t *BTree) Delete(key []byte) (err error) {
 	if t == nil {
@@ -84,6 +148,9 @@ func (t *BTree) Delete(key []byte) (err error) {
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	_, err = t.root.extract(t.store, nil, t.collate, key)
 	return
@@ -97,10 +164,34 @@ func (t *BTree) DeleteAny() (empty bool, err error) {
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	return t.root.deleteAny(t.store)
 }
 
+// DeleteRange deletes the keys in the range [from, to), and their associated
+// values, from the tree. A nil from is before the first key and a nil to is
+// past the last key of the tree, ie. DeleteRange(nil, nil) empties the tree
+// like Clear.
+//
+// The data pages and index subtrees entirely within the range are freed at
+// once, without deleting their keys one by one. Only the pages at the range
+// boundaries are then concatenated with or balanced against their siblings.
+func (t *BTree) DeleteRange(from, to []byte) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.serial++
+	return t.root.deleteRange(t.store, t.collate, from, to)
+}
+
 func elem(v interface{}) string {
 	switch x := v.(type) {
 	default:
@@ -139,6 +230,14 @@ func elem(v interface{}) string {
 // example a float value '17.' and an integer value '17' may both output as
 // '17'.
 func (t *BTree) Dump(w io.Writer) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	enum, err := t.seekFirst()
 	if err != nil {
 		return
@@ -207,6 +306,9 @@ func (t *BTree) Extract(buf, key []byte) (value []byte, err error) {
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	return t.root.extract(t.store, buf, t.collate, key)
 }
@@ -219,6 +321,9 @@ func (t *BTree) First() (key, value []byte, err error) {
 		return
 	}
 
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	var p btreeDataPage
 	if _, p, err = t.root.first(t.store); err != nil || p == nil {
 		return
@@ -237,14 +342,17 @@ func (t *BTree) First() (key, value []byte, err error) {
 // the entire content.  Otherwise, a newly allocated slice will be returned.
 // It is valid to pass a nil buf.
 //
-// Get is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// Get is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
 func (t *BTree) Get(buf, key []byte) (value []byte, err error) {
 	if t == nil {
 		err = errors.New("BTree method invoked on nil receiver")
 		return
 	}
 
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	buffer := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(buffer)
 	if buffer, err = t.root.get(t.store, buffer, t.collate, key); buffer == nil || err != nil {
@@ -256,6 +364,47 @@ func (t *BTree) Get(buf, key []byte) (value []byte, err error) {
 	return
 }
 
+// View calls f with the value associated with key, if such value exists, and
+// returns whether it does. Unlike Get, View does not allocate. The slice passed
+// to f refers to the page the value is embedded in or, for a value stored in
+// its own block, to a pooled buffer the value is copied to. It's valid only for
+// the duration of f, which must not modify it. Any error returned by f is
+// returned by View.
+//
+// View is safe for concurrent use by multiple goroutines. The tree is not
+// locked while f runs, so f may use the tree as well.
+func (t *BTree) View(key []byte, f func(value []byte) error) (ok bool, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	buffer := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(buffer)
+	vbuf := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(vbuf)
+	var value []byte
+	if value, ok, err = t.view(buffer, vbuf, key); !ok || err != nil {
+		return
+	}
+
+	return true, f(value)
+}
+
+func (t *BTree) view(buf, vbuf, key []byte) (value []byte, ok bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var p btreeDataPage
+	var index int
+	if p, index, ok, err = t.root.lookup(t.store, buf, t.collate, key); !ok || err != nil {
+		return
+	}
+
+	value, err = p.viewValue(t.store, index, vbuf)
+	return value, err == nil, err
+}
+
 // Handle reports t's handle.
 func (t *BTree) Handle() int64 {
 	return int64(t.root)
@@ -269,6 +418,9 @@ func (t *BTree) Last() (key, value []byte, err error) {
 		return
 	}
 
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	var p btreeDataPage
 	if _, p, err = t.root.last(t.store); err != nil || p == nil {
 		return
@@ -283,6 +435,46 @@ func (t *BTree) Last() (key, value []byte, err error) {
 	return
 }
 
+// Len returns the number of KV pairs in the tree.
+//
+// The index pages of a tree keep the number of KV pairs in the subtrees of
+// their children, so Len, Count, Nth and Rank are O(log N). Trees created by
+// older versions of this package, before the counts were introduced, lack
+// them until they shrink to at most a single data page. Those methods are
+// O(N) for such trees.
+//
+// Len is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
+func (t *BTree) Len() (n int64, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.len(t.store)
+}
+
+// Nth returns the KV pair at the zero based position index in the collation
+// order of the keys. An index out of range is an error. See Len about the
+// time complexity.
+//
+// Nth is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
+func (t *BTree) Nth(index int64) (key, value []byte, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.nth(t.store, index)
+}
+
 // Put combines Get and Set in a more efficient way where the tree is walked
 // only once.  The upd(ater) receives the current (key, old-value), if that
 // exists or (key, nil) otherwise.  It can then return a (new-value, true, nil)
@@ -301,32 +493,87 @@ func (t *BTree) Last() (key, value []byte, err error) {
 // The returned slice may be a sub-slice of buf if buf was large enough to hold
 // the entire content.  Otherwise, a newly allocated slice will be returned.
 // It is valid to pass a nil buf.
+//
+// The tree is locked while upd runs, upd must not invoke the methods of t.
 func (t *BTree) Put(buf, key []byte, upd func(key, old []byte) (new []byte, write bool, err error)) (old []byte, written bool, err error) {
 	if t == nil {
 		err = errors.New("BTree method invoked on nil receiver")
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	return t.root.put2(buf, t.store, t.collate, key, upd)
 }
 
+// Rank returns the number of keys in the tree collating before key, ie. the
+// position of key, if it exists, or the position where it would be inserted.
+// See Len about the time complexity.
+//
+// Rank is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
+func (t *BTree) Rank(key []byte) (n int64, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.rank(t.store, t.collate, key)
+}
+
+// Rehandle replaces in the tree the handles of the blocks which
+// Allocator.CompactRehandle gave new handles, as reported in its moved result.
+// That includes the handle of the tree itself, so Handle may report a new
+// value after Rehandle. Rehandle reads the tree only using the new handles. It
+// must be invoked, or RehandleBTree for the trees which are not open, exactly
+// once for every tree having blocks in the Allocator before they are used
+// again. The enumerators of the tree see Rehandle as a mutation.
+func (t *BTree) Rehandle(moved map[int64]int64) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	if t.IsMem() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.serial++
+	t.root = btree(rehandled(moved, int64(t.root)))
+	return t.root.rehandle(t.store, moved)
+}
+
 // Seek returns an Enumerator with "position" or an error of any. Normally the
 // position is on a KV pair such that key >= KV.key. Then hit is key == KV.key.
 // The position is possibly "after" the last KV pair, but that is not an error.
 //
-// Seek is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// Seek is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
 func (t *BTree) Seek(key []byte) (enum *BTreeEnumerator, hit bool, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	enum0, hit, err := t.seek(key)
 	if err != nil {
 		return
 	}
 
 	enum = &BTreeEnumerator{
-		enum:     enum0,
-		firstHit: hit,
-		key:      append([]byte(nil), key...),
+		enum: enum0,
+		key:  append([]byte(nil), key...),
 	}
 	return
 }
@@ -352,18 +599,25 @@ func (t *BTree) seek(key []byte) (enum *bTreeEnumerator, hit bool, err error) {
 // an error.  The collate function originally passed to CreateBTree is used for
 // enumerating the tree but a custom collate function c is used for IndexSeek.
 //
-// IndexSeek is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// IndexSeek is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
 func (t *BTree) IndexSeek(key []byte, c func(a, b []byte) int) (enum *BTreeEnumerator, hit bool, err error) { //TODO +test
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	enum0, hit, err := t.indexSeek(key, c)
 	if err != nil {
 		return
 	}
 
 	enum = &BTreeEnumerator{
-		enum:     enum0,
-		firstHit: hit,
-		key:      append([]byte(nil), key...),
+		enum: enum0,
+		key:  append([]byte(nil), key...),
 	}
 	return
 }
@@ -386,9 +640,17 @@ func (t *BTree) indexSeek(key []byte, c func(a, b []byte) int) (enum *bTreeEnume
 // seekFirst returns an enumerator positioned on the first KV pair in the tree,
 // if any.  For an empty tree, err == io.EOF is returend.
 //
-// SeekFirst is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// SeekFirst is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
 func (t *BTree) SeekFirst() (enum *BTreeEnumerator, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	enum0, err := t.seekFirst()
 	if err != nil {
 		return
@@ -400,9 +662,8 @@ func (t *BTree) SeekFirst() (enum *BTreeEnumerator, err error) {
 	}
 
 	enum = &BTreeEnumerator{
-		enum:     enum0,
-		firstHit: true,
-		key:      append([]byte(nil), key...),
+		enum: enum0,
+		key:  append([]byte(nil), key...),
 	}
 	return
 }
@@ -427,9 +688,17 @@ func (t *BTree) seekFirst() (enum *bTreeEnumerator, err error) {
 // seekLast returns an enumerator positioned on the last KV pair in the tree,
 // if any.  For an empty tree, err == io.EOF is returend.
 //
-// SeekLast is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// SeekLast is safe for concurrent use by multiple goroutines. It runs
+// concurrently with the other reading methods.
 func (t *BTree) SeekLast() (enum *BTreeEnumerator, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	enum0, err := t.seekLast()
 	if err != nil {
 		return
@@ -441,9 +710,8 @@ func (t *BTree) SeekLast() (enum *BTreeEnumerator, err error) {
 	}
 
 	enum = &BTreeEnumerator{
-		enum:     enum0,
-		firstHit: true,
-		key:      append([]byte(nil), key...),
+		enum: enum0,
+		key:  append([]byte(nil), key...),
 	}
 	return
 }
@@ -473,6 +741,9 @@ func (t *BTree) Set(key, value []byte) (err error) {
 		return
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.serial++
 	dst := bufs.GCache.Get(maxBuf)
 	_, err = t.root.put(dst, t.store, t.collate, key, value, true)
@@ -480,6 +751,123 @@ func (t *BTree) Set(key, value []byte) (err error) {
 	return
 }
 
+// SetPrefixCompression selects the format of the data pages of the tree. If on
+// is true, the data pages created or split from now on store a prefix common
+// to all their keys only once and the keys without it. If the keys share long
+// prefixes, that saves space and the reading of keys stored out of line. Pages
+// already present keep their format until they are split, pages of both
+// formats can be mixed in one tree. The selection is recorded in the tree.
+//
+// Trees with prefix compressed data pages cannot be read by versions of this
+// package which do not know the format.
+func (t *BTree) SetPrefixCompression(on bool) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, err := t.store.Get(nil, int64(t.root))
+	if err != nil {
+		return
+	}
+
+	flags := btreeRootFlags(r) &^ btreeFlagPrefix
+	if on {
+		flags |= btreeFlagPrefix
+	}
+	return t.root.setFlags(t.store, flags)
+}
+
+// BTreeStats record statistics about a BTree. They are returned by
+// BTree.Stats and BTree.Verify.
+type BTreeStats struct {
+	Depth          int     // levels of pages, 0 for an empty tree
+	IndexPages     int64   // number of index pages
+	DataPages      int64   // number of data pages
+	Items          int64   // number of KV pairs
+	IndexFill      float64 // average fill factor of the index pages, in [0, 1]
+	DataFill       float64 // average fill factor of the data pages, in [0, 1]
+	OverflowKeys   int64   // number of keys stored out of line
+	OverflowValues int64   // number of values stored out of line
+	KeyBytes       int64   // total size of the keys
+	ValueBytes     int64   // total size of the values
+}
+
+// item records the KV pair at off in p, its key and value are klen and vlen
+// bytes long.
+func (st *BTreeStats) item(p btreeDataPage, off, klen, vlen int) {
+	st.KeyBytes += int64(klen)
+	st.ValueBytes += int64(vlen)
+	if p[off] >= kKV {
+		st.OverflowKeys++
+	}
+	if p[off+kKV] >= kKV {
+		st.OverflowValues++
+	}
+}
+
+// fill computes the fill factors from the page counts. Every data page but
+// the first one is referred to by exactly one index page item and a full index
+// page has 2*kIndex items.
+func (st *BTreeStats) fill() {
+	if st.IndexPages != 0 {
+		st.IndexFill = float64(st.DataPages-1) / float64(st.IndexPages*2*kIndex)
+	}
+	if st.DataPages != 0 {
+		st.DataFill = float64(st.Items) / float64(st.DataPages*2*kData)
+	}
+}
+
+// Stats returns statistics about the shape of the tree and the space used by
+// its KV pairs. Stats reads all pages of the tree and all the out of line
+// parts of keys and values, but it does not verify the tree. See also Verify.
+func (t *BTree) Stats() (stats BTreeStats, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.stats(t.store)
+}
+
+// Verify attempts to find any structural errors in the tree. It checks the
+// ordering of the keys wrt the collating function of the tree, the fill of the
+// pages, the consistency of the index pages with their subtrees, the links of
+// the data pages and the handles of the overflowed keys and values.
+//
+// Any problems found are reported to 'log' as an *ErrILSEQ of type ErrBTree.
+// If 'log' returns false or the error doesn't allow to continue, the
+// verification process is stopped and an error is returned from Verify.
+// Passing a nil log works like providing a log function always returning
+// false. Errors of the underlying store, like read errors, are not reported to
+// 'log' but returned immediately. Verify returns nil only if it completed
+// verifying the tree without detecting any error.
+//
+// The statistics are valid only if Verify returned a nil error. Verify does
+// not check the blocks of the tree on the level of the Allocator, see
+// Allocator.Verify for that.
+func (t *BTree) Verify(log func(error) bool) (stats BTreeStats, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	if log == nil {
+		log = nolog
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.verify(t.store, t.collate, log)
+}
+
 // bTreeEnumerator is a closure of a BTree and a position. It is returned from
 // BTree.seek.
 //
@@ -523,6 +911,32 @@ func (e *bTreeEnumerator) current() (key, value []byte, err error) {
 	return
 }
 
+// view is like current, but the KV pair is not copied, see
+// btreeDataPage.view. The key is assembled in kbuf and the value in vbuf, if
+// necessary.
+func (e *bTreeEnumerator) view(kbuf, vbuf []byte) (key, value []byte, err error) {
+	if e == nil {
+		err = errors.New("bTreeEnumerator method invoked on nil receiver")
+		return
+	}
+
+	if e.serial != e.t.serial {
+		err = &ErrINVAL{Src: "bTreeEnumerator invalidated by updating the tree"}
+		return
+	}
+
+	if e.p == nil || e.index == e.p.len() {
+		return nil, nil, io.EOF
+	}
+
+	if key, err = e.p.viewKey(e.t.store, e.index, kbuf); err != nil {
+		return
+	}
+
+	value, err = e.p.viewValue(e.t.store, e.index, vbuf)
+	return
+}
+
 // Next attempts to position the enumerator onto the next KV pair wrt the
 // current position. If there is no "next" KV pair, io.EOF is returned.
 //
@@ -605,63 +1019,128 @@ func (e *bTreeEnumerator) prev() (err error) {
 // from the Seek* methods.  The enumerator is aware of any mutations made to
 // the tree in the process of enumerating it and automatically resumes the
 // enumeration.
+//
+// After a mutation, Next returns the first KV pair which key collates after the
+// key last returned and Prev returns the last KV pair which key collates
+// before it. Keys can thus be deleted or values updated while enumerating the
+// tree, for example
+//
+//	for {
+//		k, _, err := enum.Next()
+//		if err != nil {
+//			...
+//		}
+//
+//		if err = tree.Delete(k); err != nil {
+//			...
+//		}
+//	}
+//
+// The enumeration does not resume after it returned io.EOF, even if KV pairs
+// were added at its end meanwhile.
 type BTreeEnumerator struct {
 	enum     *bTreeEnumerator
 	err      error
-	key      []byte
-	firstHit bool
+	key      []byte // Last key returned or the key enum was positioned at.
+	returned bool   // Key was returned by Next or Prev.
 }
 
-// Next returns the currently enumerated KV pair, if it exists and moves to the
-// next KV in the key collation order. If there is no KV pair to return, err ==
-// io.EOF is returned.
-//
-// Next is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
-func (e *BTreeEnumerator) Next() (key, value []byte, err error) {
-	if err = e.err; err != nil {
+// reseek positions the enumerator, invalidated by a mutation of the tree, to
+// the KV pair to be returned next by Next or, if !forward, by Prev.
+func (e *BTreeEnumerator) reseek(forward bool) (err error) {
+	var hit bool
+	if e.enum, hit, err = e.enum.t.seek(e.key); err != nil {
 		return
 	}
 
+	switch {
+	case forward:
+		if hit && e.returned {
+			return e.enum.next()
+		}
+	default:
+		if e.returned {
+			return e.enum.prev()
+		}
+	}
+	return
+}
+
+// current returns the KV pair to be returned by Next or, if !forward, by Prev,
+// as obtained by get. The enumeration is resumed first if it was invalidated
+// by a mutation of the tree.
+func (e *BTreeEnumerator) current(forward bool, get func(*bTreeEnumerator) (key, value []byte, err error)) (key, value []byte, err error) {
 	canRetry := true
 retry:
-	if e.enum.p == nil {
-		e.err = io.EOF
-		return nil, nil, e.err
-	}
+	if forward {
+		if e.enum.p == nil {
+			return nil, nil, io.EOF
+		}
 
-	if e.enum.index == e.enum.p.len() && e.enum.serial == e.enum.t.serial {
-		if err := e.enum.next(); err != nil {
-			e.err = err
-			return nil, nil, e.err
+		if e.enum.index == e.enum.p.len() && e.enum.serial == e.enum.t.serial {
+			if err = e.enum.next(); err != nil {
+				return
+			}
 		}
 	}
 
-	if key, value, err = e.enum.current(); err != nil {
+	if key, value, err = get(e.enum); err != nil {
 		if _, ok := err.(*ErrINVAL); !ok || !canRetry {
-			e.err = err
 			return
 		}
 
 		canRetry = false
-		var hit bool
-		if e.enum, hit, err = e.enum.t.seek(e.key); err != nil {
-			e.err = err
+		if err = e.reseek(forward); err != nil {
 			return
 		}
 
-		if !e.firstHit && hit {
-			err = e.enum.next()
-			if err != nil {
-				e.err = err
-				return
-			}
-		}
-
 		goto retry
 	}
 
-	e.firstHit = false
+	e.returned = true
+	return
+}
+
+// advance moves the enumerator to the KV pair following, or if !forward,
+// preceding the one last returned. An enumerator invalidated meanwhile is left
+// to be resumed by the next call of Next or Prev.
+func (e *BTreeEnumerator) advance(forward bool) {
+	t := e.enum.t
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if e.enum.serial != t.serial {
+		return
+	}
+
+	if forward {
+		e.err = e.enum.next()
+		return
+	}
+
+	e.err = e.enum.prev()
+}
+
+// Next returns the currently enumerated KV pair, if it exists and moves to the
+// next KV in the key collation order. If there is no KV pair to return, err ==
+// io.EOF is returned.
+//
+// Next is safe for concurrent use with the methods of the enumerated tree, but
+// an enumerator must not be used by more than one goroutine at a time.
+func (e *BTreeEnumerator) Next() (key, value []byte, err error) {
+	if err = e.err; err != nil {
+		return
+	}
+
+	t := e.enum.t
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if key, value, err = e.current(true, (*bTreeEnumerator).current); err != nil {
+		e.err = err
+		return
+	}
+
 	e.key = append([]byte(nil), key...)
 	e.err = e.enum.next()
 	return
@@ -671,74 +1150,197 @@ retry:
 // previous KV in the key collation order. If there is no KV pair to return,
 // err == io.EOF is returned.
 //
-// Prev is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the tree.
+// Prev is safe for concurrent use with the methods of the enumerated tree, but
+// an enumerator must not be used by more than one goroutine at a time.
 func (e *BTreeEnumerator) Prev() (key, value []byte, err error) {
 	if err = e.err; err != nil {
 		return
 	}
 
-	canRetry := true
-retry:
-	if key, value, err = e.enum.current(); err != nil {
-		if _, ok := err.(*ErrINVAL); !ok || !canRetry {
-			e.err = err
-			return
-		}
-
-		canRetry = false
-		var hit bool
-		if e.enum, hit, err = e.enum.t.seek(e.key); err != nil {
-			e.err = err
-			return
-		}
-
-		if !e.firstHit && hit {
-			err = e.enum.prev()
-			if err != nil {
-				e.err = err
-				return
-			}
-		}
+	t := e.enum.t
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-		goto retry
+	if key, value, err = e.current(false, (*bTreeEnumerator).current); err != nil {
+		e.err = err
+		return
 	}
 
-	e.firstHit = false
 	e.key = append([]byte(nil), key...)
 	e.err = e.enum.prev()
 	return
 }
 
+// NextView is like Next, but instead of returning newly allocated copies of
+// the currently enumerated KV pair, it calls f with the key and value as found
+// in the page or in the pooled buffers of the enumerator. Keys with a page
+// prefix and content stored in its own block are still copied to those
+// buffers, but NextView does not allocate. The slices are valid only for the
+// duration of f, which must not modify them. Any error returned by f is
+// returned by NextView, the enumerator moves to the next KV pair regardless.
+//
+// The tree is not locked while f runs, so f may use the tree as well,
+// including mutating it like between calls of Next.
+func (e *BTreeEnumerator) NextView(f func(key, value []byte) error) error {
+	return e.view(true, f)
+}
+
+// PrevView is like Prev, but it calls f with the KV pair instead of returning
+// its copies. See NextView for details.
+func (e *BTreeEnumerator) PrevView(f func(key, value []byte) error) error {
+	return e.view(false, f)
+}
+
+func (e *BTreeEnumerator) view(forward bool, f func(key, value []byte) error) (err error) {
+	if err = e.err; err != nil {
+		return
+	}
+
+	kbuf := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(kbuf)
+	vbuf := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(vbuf)
+	key, value, err := e.viewCurrent(forward, kbuf, vbuf)
+	if err != nil {
+		e.err = err
+		return
+	}
+
+	err = f(key, value)
+	e.advance(forward)
+	return
+}
+
+func (e *BTreeEnumerator) viewCurrent(forward bool, kbuf, vbuf []byte) (key, value []byte, err error) {
+	t := e.enum.t
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if key, value, err = e.current(forward, func(enum *bTreeEnumerator) ([]byte, []byte, error) {
+		return enum.view(kbuf, vbuf)
+	}); err != nil {
+		return
+	}
+
+	e.key = append(e.key[:0], key...)
+	return
+}
+
 // CreateBTree creates a new BTree in store. It returns the tree, its (freshly
-// assigned) handle (for OpenBTree or RemoveBTree) or an error, if any.
+// assigned) handle (for OpenBTree or RemoveBTree) or an error, if any. If
+// collate is registered by RegisterCollation, its name is recorded in the tree
+// and OpenBTree then refuses to open the tree using another collation. That
+// protects the tree from being opened with an ordering of keys other than the
+// one it was built with.
 func CreateBTree(store *Allocator, collate func(a, b []byte) int) (bt *BTree, handle int64, err error) {
 	r := &BTree{store: store, collate: collate}
-	if r.root, err = newBTree(store); err != nil {
+	name := collationName(collate)
+	if name == "" {
+		if r.root, err = newBTree(store); err != nil {
+			return
+		}
+
+		return r, int64(r.root), nil
+	}
+
+	if handle, err = store.Alloc(append(make([]byte, 7, 7+len(name)), name...)); err != nil {
+		return
+	}
+
+	r.root = btree(handle)
+	return r, handle, nil
+}
+
+// CreateBTreeCollation is like CreateBTree using the collation registered by
+// RegisterCollation as name. It's a convenience for clients knowing the
+// collation only by its name.
+func CreateBTreeCollation(store *Allocator, name string) (bt *BTree, handle int64, err error) {
+	collate := collation(name)
+	if collate == nil {
+		return nil, 0, &ErrINVAL{"CreateBTreeCollation: collation not registered", name}
+	}
+
+	return CreateBTree(store, collate)
+}
+
+// CreateBTreeFromSorted creates a new BTree in store and loads it with the KV
+// pairs returned by next. It returns the tree, its (freshly assigned) handle
+// (for OpenBTree or RemoveBTree) or an error, if any.
+//
+// Next must return the KV pairs ordered by strictly increasing keys, as
+// defined by collate, and io.EOF after the last pair. The tree is built
+// bottom-up from full data pages and their index pages, which is much faster
+// than Setting the pairs one by one and the resulting tree uses less space.
+//
+// If next returns an error other than io.EOF or a key out of order, the tree
+// is removed from store and the error is returned.
+func CreateBTreeFromSorted(store *Allocator, collate func(a, b []byte) int, next func() (k, v []byte, err error)) (bt *BTree, handle int64, err error) {
+	if bt, handle, err = CreateBTree(store, collate); err != nil {
 		return
 	}
 
-	return r, int64(r.root), nil
+	if err = bt.root.load(store, collate, next); err != nil {
+		store.Free(handle)
+		return nil, 0, err
+	}
+
+	return
 }
 
 // OpenBTree opens a store's BTree using handle. It returns the tree or an
 // error, if any. The same tree may be opened more than once, but operations on
 // the separate instances should not ever overlap or void the other instances.
 // However, the intended API usage is to open the same tree handle only once
-// (handled by some upper layer "dispatcher").
+// (handled by some upper layer "dispatcher"). The separate instances do not
+// synchronize with each other.
+//
+// If a collation name is recorded in the tree, see CreateBTree, collate must
+// be the collation registered by that name. Otherwise an *ErrCollation is
+// returned. Trees without a recorded collation name can be opened using any
+// collation.
 func OpenBTree(store *Allocator, collate func(a, b []byte) int, handle int64) (bt *BTree, err error) {
-	r := &BTree{store: store, root: btree(handle), collate: collate}
-	b := bufs.GCache.Get(7)
-	defer bufs.GCache.Put(b)
-	if b, err = store.Get(b, handle); err != nil {
+	bt, name, err := openBTree(store, collate, handle)
+	if err != nil || name == "" {
+		return
+	}
+
+	if g := collationName(collate); g != name {
+		return nil, &ErrCollation{handle, name, g}
+	}
+
+	return
+}
+
+// OpenBTreeCollation is like OpenBTree using the collation registered by
+// RegisterCollation as name, but it fails also if the tree has no recorded
+// collation name.
+func OpenBTreeCollation(store *Allocator, name string, handle int64) (bt *BTree, err error) {
+	collate := collation(name)
+	if collate == nil {
+		return nil, &ErrINVAL{"OpenBTreeCollation: collation not registered", name}
+	}
+
+	bt, g, err := openBTree(store, collate, handle)
+	if err == nil && g != name {
+		return nil, &ErrCollation{handle, g, name}
+	}
+
+	return
+}
+
+// openBTree opens a store's BTree using handle. It returns the tree and the
+// name of the collation recorded in the tree.
+func openBTree(store *Allocator, collate func(a, b []byte) int, handle int64) (bt *BTree, name string, err error) {
+	b, err := store.Get(nil, handle)
+	if err != nil {
 		return
 	}
 
-	if len(b) != 7 {
-		return nil, &ErrILSEQ{Off: h2off(handle), More: "btree.go:671"}
+	if len(b) < 7 {
+		return nil, "", &ErrILSEQ{Off: h2off(handle), More: "btree.go:671"}
 	}
 
-	return r, nil
+	return &BTree{store: store, root: btree(handle), collate: collate}, btreeRootName(b), nil
 }
 
 // RemoveBTree removes tree, represented by handle from store. Empty trees are
@@ -747,7 +1349,7 @@ func OpenBTree(store *Allocator, collate func(a, b []byte) int, handle int64) (b
 // not/never remove it.  One advantage of such approach is a stable handle of
 // such tree.
 func RemoveBTree(store *Allocator, handle int64) (err error) {
-	tree, err := OpenBTree(store, nil, handle)
+	tree, _, err := openBTree(store, nil, handle)
 	if err != nil {
 		return
 	}
@@ -759,6 +1361,26 @@ func RemoveBTree(store *Allocator, handle int64) (err error) {
 	return store.Free(handle)
 }
 
+// RehandleBTree is like BTree.Rehandle for a tree, represented by handle,
+// which is not open. Handle is the handle of the tree before
+// Allocator.CompactRehandle moved its blocks. RehandleBTree returns the new
+// handle of the tree.
+func RehandleBTree(store *Allocator, handle int64, moved map[int64]int64) (newHandle int64, err error) {
+	newHandle = rehandled(moved, handle)
+	return newHandle, btree(newHandle).rehandle(store, moved)
+}
+
+// rehandled returns the new handle of handle, as reported in moved, or handle
+// if it was not moved. Moved is keyed by handles without generations, the
+// generation of handle, if any, is kept.
+func rehandled(moved map[int64]int64, handle int64) int64 {
+	if h, ok := moved[handle&maxHandle]; ok {
+		return h | handle&^maxHandle
+	}
+
+	return handle
+}
+
 type btreeStore interface {
 	Alloc(b []byte) (handle int64, err error)
 	Free(handle int64) (err error)
@@ -874,56 +1496,122 @@ Offsets into the raw []byte:
 Child[X]    == 1+14*X
 DataPage[X] == 8+14*X
 
+A counted index page has the flag 2. Its items are 21 bytes each, every child
+is followed by the number of KV pairs in the child's subtree.
+
+	Count = (len(raw) - 15) / 21
+
+	  0..6     7..13     14..20
+	+-------+--------+----------+
+	| Child |   N    | DataPage |
+	+-------+--------+----------+
+
+	N == number of KV pairs in the subtree Child
+
+Offsets into the raw []byte:
+Child[X]    == 1+21*X
+N[X]        == 8+21*X
+DataPage[X] == 15+21*X
+
+All index pages of a tree are either counted or not. Trees created before
+counted index pages existed remain uncounted until they shrink to a single
+data page again.
 */
 type btreeIndexPage []byte
 
-func newBTreeIndexPage(leftmostChild int64) (p btreeIndexPage) {
-	p = bufs.GCache.Get(1 + (kIndex+1)*2*7)[:8]
-	p[0] = tagBTreeIndexPage
+func newBTreeIndexPage(tag byte, leftmostChild int64) (p btreeIndexPage) {
+	p = bufs.GCache.Get(1 + (kIndex+1)*3*7)[:1]
+	p[0] = tag
+	p = p.setLen(0)
 	h2b(p[1:], leftmostChild)
+	p.setCount(0, 0)
 	return
 }
 
+func (p btreeIndexPage) counted() bool {
+	return p[0] == tagBTreeCountedIndexPage
+}
+
+// w returns the size of the child field of p, including its count, if any.
+func (p btreeIndexPage) w() int {
+	if p.counted() {
+		return 14
+	}
+
+	return 7
+}
+
+// off returns the offset of the child field at index.
+func (p btreeIndexPage) off(index int) int {
+	return 1 + (p.w()+7)*index
+}
+
 func (p btreeIndexPage) len() int {
-	return (len(p) - 8) / 14
+	w := p.w()
+	return (len(p) - 1 - w) / (w + 7)
 }
 
 func (p btreeIndexPage) child(index int) int64 {
-	return b2h(p[1+14*index:])
+	return b2h(p[p.off(index):])
 }
 
 func (p btreeIndexPage) setChild(index int, dp int64) {
-	h2b(p[1+14*index:], dp)
+	h2b(p[p.off(index):], dp)
+}
+
+// count returns the number of KV pairs in the subtree of the child at index
+// of a counted page.
+func (p btreeIndexPage) count(index int) int64 {
+	if !p.counted() {
+		return 0
+	}
+
+	return b2h(p[p.off(index)+7:])
+}
+
+// setCount is a nop for pages which are not counted.
+func (p btreeIndexPage) setCount(index int, n int64) {
+	if p.counted() {
+		h2b(p[p.off(index)+7:], n)
+	}
+}
+
+// sum returns the sum of the counts of the children in [from, to).
+func (p btreeIndexPage) sum(from, to int) (n int64) {
+	for i := from; i < to; i++ {
+		n += p.count(i)
+	}
+	return
 }
 
 func (p btreeIndexPage) dataPage(index int) int64 {
-	return b2h(p[8+14*index:])
+	return b2h(p[p.off(index)+p.w():])
 }
 
 func (p btreeIndexPage) setDataPage(index int, dp int64) {
-	h2b(p[8+14*index:], dp)
+	h2b(p[p.off(index)+p.w():], dp)
 }
 
 func (q btreeIndexPage) insert(index int) btreeIndexPage {
-	switch len0 := q.len(); {
+	switch len0, w := q.len(), q.w(); {
 	case index < len0:
 		has := len(q)
-		need := has + 14
+		need := has + w + 7
 		switch {
 		case cap(q) >= need:
 			q = q[:need]
 		default:
-			q = append(q, zeros[:14]...)
+			q = append(q, zeros[:w+7]...)
 		}
-		copy(q[8+14*(index+1):8+14*(index+1)+2*(len0-index)*7], q[8+14*index:])
+		copy(q[q.off(index+1)+w:], q[q.off(index)+w:has])
 	case index == len0:
 		has := len(q)
-		need := has + 14
+		need := has + w + 7
 		switch {
 		case cap(q) >= need:
 			q = q[:need]
 		default:
-			q = append(q, zeros[:14]...)
+			q = append(q, zeros[:w+7]...)
 		}
 	}
 	return q
@@ -933,6 +1621,7 @@ func (p btreeIndexPage) insert3(index int, dataPage, child int64) btreeIndexPage
 	p = p.insert(index)
 	p.setDataPage(index, dataPage)
 	p.setChild(index+1, child)
+	p.setCount(index+1, 0)
 	return p
 }
 
@@ -949,7 +1638,7 @@ func (p btreeIndexPage) cmp(a btreeStore, c func(a, b []byte) int, keyA []byte,
 
 func (q btreeIndexPage) setLen(n int) btreeIndexPage {
 	q = q[:cap(q)]
-	need := 8 + 14*n
+	need := q.off(n) + q.w()
 	if need < len(q) {
 		return q[:need]
 	}
@@ -957,7 +1646,7 @@ func (q btreeIndexPage) setLen(n int) btreeIndexPage {
 }
 
 func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64, parentIndex int, index *int) (btreeIndexPage, error) {
-	right := newBTreeIndexPage(0)
+	right := newBTreeIndexPage(p[0], 0)
 	canRecycle := true
 	defer func() {
 		if canRecycle {
@@ -965,7 +1654,7 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 		}
 	}()
 	right = right.setLen(kIndex)
-	copy(right[1:1+(2*kIndex+1)*7], p[1+14*(kIndex+1):])
+	copy(right[1:], p[p.off(kIndex+1):])
 	p = p.setLen(kIndex)
 	if err := a.Realloc(*ph, p); err != nil {
 		return nil, err
@@ -983,20 +1672,24 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 			return nil, err
 		}
 		pp = pp.insert3(parentIndex, p.dataPage(kIndex), rh)
+		pp.setCount(parentIndex, p.sum(0, kIndex+1))
+		pp.setCount(parentIndex+1, right.sum(0, kIndex+1))
 		if err = a.Realloc(parent, pp); err != nil {
 			return nil, err
 		}
 
 	} else {
-		nr := newBTreeIndexPage(*ph)
+		nr := newBTreeIndexPage(p[0], *ph)
 		defer bufs.GCache.Put(nr)
 		nr = nr.insert3(0, p.dataPage(kIndex), rh)
+		nr.setCount(0, p.sum(0, kIndex+1))
+		nr.setCount(1, right.sum(0, kIndex+1))
 		nrh, err := a.Alloc(nr)
 		if err != nil {
 			return nil, err
 		}
 
-		if err = a.Realloc(int64(root), h2b(make([]byte, 7), nrh)); err != nil {
+		if err = root.setRoot(a, nrh); err != nil {
 			return nil, err
 		}
 	}
@@ -1013,8 +1706,7 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 func (p btreeIndexPage) extract(index int) btreeIndexPage {
 	n := p.len() - 1
 	if index < n {
-		sz := (n-index)*14 + 7
-		copy(p[1+14*index:1+14*index+sz], p[1+14*(index+1):])
+		copy(p[p.off(index):], p[p.off(index+1):])
 	}
 	return p.setLen(n)
 }
@@ -1043,12 +1735,15 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 
 			pc := p.len()
 			p = p.setLen(pc + 1)
-			di, si, sz := 1+1*14, 1+0*14, (2*pc+1)*7
-			copy(p[di:di+sz], p[si:])
-			p.setChild(0, btreeIndexPage(left).child(lc))
+			copy(p[p.off(1):], p[p.off(0):p.off(pc)+p.w()])
+			n := left.count(lc)
+			p.setChild(0, left.child(lc))
+			p.setCount(0, n)
 			p.setDataPage(0, btreeIndexPage(pp).dataPage(parentIndex-1))
 			*index++
-			btreeIndexPage(pp).setDataPage(parentIndex-1, btreeIndexPage(left).dataPage(lc-1))
+			btreeIndexPage(pp).setDataPage(parentIndex-1, left.dataPage(lc-1))
+			btreeIndexPage(pp).setCount(parentIndex-1, btreeIndexPage(pp).count(parentIndex-1)-n)
+			btreeIndexPage(pp).setCount(parentIndex, btreeIndexPage(pp).count(parentIndex)+n)
 			left = left.setLen(lc - 1)
 			if err = a.Realloc(parent, pp); err != nil {
 				return nil, err
@@ -1080,10 +1775,13 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 			p = p.setLen(pc + 1)
 			p.setDataPage(pc, btreeIndexPage(pp).dataPage(parentIndex))
 			pc++
+			n := btreeIndexPage(right).count(0)
 			p.setChild(pc, btreeIndexPage(right).child(0))
+			p.setCount(pc, n)
 			btreeIndexPage(pp).setDataPage(parentIndex, btreeIndexPage(right).dataPage(0))
-			di, si, sz := 1+0*14, 1+1*14, (2*rc+1)*7
-			copy(right[di:di+sz], right[si:])
+			btreeIndexPage(pp).setCount(parentIndex, btreeIndexPage(pp).count(parentIndex)+n)
+			btreeIndexPage(pp).setCount(parentIndex+1, btreeIndexPage(pp).count(parentIndex+1)-n)
+			copy(right[1:], right[btreeIndexPage(right).off(1):])
 			right = btreeIndexPage(right).setLen(rc - 1)
 			if err = a.Realloc(parent, pp); err != nil {
 				return nil, err
@@ -1129,8 +1827,7 @@ func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64,
 	rc := btreeIndexPage(right).len()
 	p = p.setLen(pc + rc + 1)
 	p.setDataPage(pc, btreeIndexPage(pp).dataPage(parentIndex))
-	di, si, sz := 1+14*(pc+1), 1+0*14, (2*rc+1)*7
-	copy(p[di:di+sz], right[si:])
+	copy(p[p.off(pc+1):], right[1:])
 	if err := a.Realloc(ph, p); err != nil {
 		return nil, err
 	}
@@ -1140,21 +1837,22 @@ func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64,
 	}
 
 	if pc := btreeIndexPage(pp).len(); pc > 1 {
+		q := btreeIndexPage(pp)
+		n := q.count(parentIndex) + q.count(parentIndex+1)
 		if parentIndex < pc-1 {
-			di, si, sz := 8+parentIndex*14, 8+(parentIndex+1)*14, 2*(pc-1-parentIndex)*7
-			copy(pp[di:si+sz], pp[si:])
+			w := q.w()
+			copy(q[q.off(parentIndex)+w:], q[q.off(parentIndex+1)+w:])
 		}
-		pp = btreeIndexPage(pp).setLen(pc - 1)
-		return p, a.Realloc(parent, pp)
+		q = q.setLen(pc - 1)
+		q.setCount(parentIndex, n)
+		return p, a.Realloc(parent, q)
 	}
 
 	if err := a.Free(iroot); err != nil {
 		return nil, err
 	}
 
-	b7 := bufs.GCache.Get(7)
-	defer bufs.GCache.Put(b7)
-	return p, a.Realloc(root, h2b(b7[:7], ph))
+	return p, btree(root).setRoot(a, ph)
 }
 
 /*
@@ -1215,6 +1913,29 @@ Length >= kKV
 Offsets into the raw []byte:
 Key[X]   == 15+2*kKV*X
 Value[X] == 15+kKV+2*kKV*X
+
+A prefix compressed data page has the flag 3. The links are followed by a
+prefix common to all keys of the page, the key fields of the items then hold
+only the rest of the keys.
+
+	  15    16...16+P-1
+	+---+--------------+
+	| P |    Prefix    |
+	+---+--------------+
+
+	P      == length of the prefix, 0...255
+	Prefix == the common prefix of all keys in the page
+
+	Count = (len(raw) - 16 - P) / (2*kKV)
+
+Offsets into the raw []byte:
+Key[X]   == 16+P+2*kKV*X
+Value[X] == 16+P+kKV+2*kKV*X
+
+A tree uses prefix compressed data pages if enabled by
+BTree.SetPrefixCompression. The prefix of a page shrinks when a key not having
+it is inserted or when items are moved from a page having another prefix. It
+grows to the longest common prefix of the keys when the page is split.
 */
 type btreeDataPage []byte
 
@@ -1231,12 +1952,30 @@ func newBTreeDataPageAlloc(a btreeStore) (p btreeDataPage, h int64, err error) {
 }
 
 func (p btreeDataPage) len() int {
-	return (len(p) - 15) / (2 * kKV)
+	return (len(p) - p.hdr()) / (2 * kKV)
+}
+
+// hdr returns the offset of the first item.
+func (p btreeDataPage) hdr() int {
+	if p[0] == tagBTreePrefixDataPage {
+		return 16 + int(p[15])
+	}
+
+	return 15
+}
+
+// prefix returns the prefix of all keys in p.
+func (p btreeDataPage) prefix() []byte {
+	if p[0] == tagBTreePrefixDataPage {
+		return p[16 : 16+int(p[15])]
+	}
+
+	return nil
 }
 
 func (q btreeDataPage) setLen(n int) btreeDataPage {
 	q = q[:cap(q)]
-	need := 15 + 2*kKV*n
+	need := q.hdr() + 2*kKV*n
 	if need < len(q) {
 		return q[:need]
 	}
@@ -1347,72 +2086,278 @@ func (p btreeDataPage) setContent(a btreeStore, off int, b []byte) (err error) {
 	return
 }
 
+func (p btreeDataPage) keyOff(index int) int {
+	return p.hdr() + 2*kKV*index
+}
+
 func (p btreeDataPage) keyField(index int) (b []byte, h int64) {
-	return p.contentField(15 + 2*kKV*index)
+	return p.contentField(p.keyOff(index))
 }
 
+// key returns the key at index, including the prefix of p.
 func (p btreeDataPage) key(a btreeStore, index int) (b []byte, err error) {
-	return p.content(a, 15+2*kKV*index)
+	if b, err = p.content(a, p.keyOff(index)); err != nil {
+		return
+	}
+
+	if prefix := p.prefix(); len(prefix) != 0 {
+		b = append(append(make([]byte, 0, len(prefix)+len(b)), prefix...), b...)
+	}
+	return
 }
 
 func (p btreeDataPage) valueField(index int) (b []byte, h int64) {
-	return p.contentField(15 + kKV + 2*kKV*index)
+	return p.contentField(p.keyOff(index) + kKV)
 }
 
 func (p btreeDataPage) value(a btreeStore, index int) (b []byte, err error) {
-	return p.content(a, 15+kKV+2*kKV*index)
+	return p.content(a, p.keyOff(index)+kKV)
 }
 
 func (p btreeDataPage) valueCopy(a btreeStore, index int) (b []byte, err error) {
-	if b, err = p.content(a, 15+kKV+2*kKV*index); err != nil {
+	if b, err = p.content(a, p.keyOff(index)+kKV); err != nil {
 		return
 	}
 
 	return append([]byte(nil), b...), nil
 }
 
+// view returns the content at off with prefix prepended, without copying it
+// when possible. The result is a sub-slice of p if prefix is empty and the
+// content is embedded. Otherwise it is assembled in buf, which is reallocated
+// only if it's too small.
+func (p btreeDataPage) view(a btreeStore, off int, prefix, buf []byte) (b []byte, err error) {
+	q := p[off:]
+	n := int(q[0])
+	if n < kKV {
+		if len(prefix) == 0 {
+			return q[1 : 1+n], nil
+		}
+
+		return append(append(buf[:0], prefix...), q[1:1+n]...), nil
+	}
+
+	// content has a handle
+	cbuf := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(cbuf)
+	c, err := a.Get(cbuf, b2h(q[kH:]))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append(append(buf[:0], prefix...), q[1:1+kSz]...), c...), nil
+}
+
+// viewKey returns the key at index, including the prefix of p. See view.
+func (p btreeDataPage) viewKey(a btreeStore, index int, buf []byte) (b []byte, err error) {
+	return p.view(a, p.keyOff(index), p.prefix(), buf)
+}
+
+// viewValue returns the value at index. See view.
+func (p btreeDataPage) viewValue(a btreeStore, index int, buf []byte) (b []byte, err error) {
+	return p.view(a, p.keyOff(index)+kKV, nil, buf)
+}
+
+// setKey sets the key at index. The key must have the prefix of p.
 func (p btreeDataPage) setKey(a btreeStore, index int, key []byte) (err error) {
-	return p.setContent(a, 15+2*kKV*index, key)
+	return p.setContent(a, p.keyOff(index), key[len(p.prefix()):])
 }
 
 func (p btreeDataPage) setValue(a btreeStore, index int, value []byte) (err error) {
-	return p.setContent(a, 15+kKV+2*kKV*index, value)
+	return p.setContent(a, p.keyOff(index)+kKV, value)
 }
 
 func (p btreeDataPage) cmp(a btreeStore, c func(a, b []byte) int, keyA []byte, keyBIndex int) (y int, err error) {
 	var keyB []byte
-	if keyB, err = p.content(a, 15+2*kKV*keyBIndex); err != nil {
+	if p[p.keyOff(keyBIndex)] >= kKV { // key has a handle
+		if keyB, err = p.key(a, keyBIndex); err != nil {
+			return
+		}
+
+		return c(keyA, keyB), nil
+	}
+
+	var b []byte
+	if len(p.prefix()) != 0 {
+		b = bufs.GCache.Get(kPrefix + kKV)
+		defer bufs.GCache.Put(b)
+	}
+	if keyB, err = p.viewKey(a, keyBIndex, b); err != nil {
 		return
 	}
 
 	return c(keyA, keyB), nil
 }
 
+// copy copies n items from src to p. The pages must have the same format and
+// prefix.
 func (p btreeDataPage) copy(src btreeDataPage, di, si, n int) {
-	do, so := 15+2*kKV*di, 15+2*kKV*si
+	do, so := p.keyOff(di), src.keyOff(si)
 	copy(p[do:do+2*kKV*n], src[so:])
 }
 
+// reformat changes the format of p to tag and its prefix to prefix, which must
+// be a prefix of all keys in p. The keys are encoded again if the prefix
+// changes.
+func (p btreeDataPage) reformat(a btreeStore, tag byte, prefix []byte) (btreeDataPage, error) {
+	if tag != tagBTreePrefixDataPage {
+		prefix = nil
+	}
+	old := p.prefix()
+	if p[0] == tag && bytes.Equal(old, prefix) {
+		return p, nil
+	}
+
+	old = append([]byte(nil), old...)
+	prefix = append([]byte(nil), prefix...)
+	n, oh := p.len(), p.hdr()
+	nh := 15
+	if tag == tagBTreePrefixDataPage {
+		nh = 16 + len(prefix)
+	}
+	items := p[oh : oh+2*kKV*n]
+	switch need := nh + 2*kKV*n; {
+	case need <= cap(p):
+		p = p[:need]
+		copy(p[nh:], items)
+	default:
+		q := make(btreeDataPage, need, need+2*kKV)
+		copy(q, p[:15])
+		copy(q[nh:], items)
+		p = q
+	}
+
+	p[0] = tag
+	if tag == tagBTreePrefixDataPage {
+		p[15] = byte(len(prefix))
+		copy(p[16:], prefix)
+	}
+	if bytes.Equal(old, prefix) {
+		return p, nil
+	}
+
+	for i := 0; i < n; i++ {
+		off := p.keyOff(i)
+		b, err := p.content(a, off)
+		if err != nil {
+			return nil, err
+		}
+
+		key := append(append([]byte(nil), old...), b...)
+		if err = p.setContent(a, off, key[len(prefix):]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// fit changes the format of p to tag. The prefix of a prefix compressed page
+// becomes the longest prefix common to all its keys. The keys need not be
+// ordered bytewise, so all of them are examined.
+func (p btreeDataPage) fit(a btreeStore, tag byte) (btreeDataPage, error) {
+	var prefix []byte
+	if tag == tagBTreePrefixDataPage && p.len() != 0 {
+		// All keys have the current prefix, only the rest of them
+		// needs to be examined.
+		var rest []byte
+		for i := 0; i < p.len(); i++ {
+			b, err := p.content(a, p.keyOff(i))
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case i == 0:
+				rest = b
+			default:
+				rest = commonPrefix(rest, b)
+			}
+		}
+		prefix = append(append([]byte(nil), p.prefix()...), rest...)
+		if len(prefix) > kPrefix {
+			prefix = prefix[:kPrefix]
+		}
+	}
+	return p.reformat(a, tag, prefix)
+}
+
+// unify makes the format and the prefix of pages p and q the same, so that
+// items can be copied between them.
+func (p btreeDataPage) unify(a btreeStore, q btreeDataPage) (btreeDataPage, btreeDataPage, error) {
+	if p[0] == q[0] && bytes.Equal(p.prefix(), q.prefix()) {
+		return p, q, nil
+	}
+
+	tag := byte(tagBTreeDataPage)
+	if p[0] == tagBTreePrefixDataPage || q[0] == tagBTreePrefixDataPage {
+		tag = tagBTreePrefixDataPage
+	}
+	var prefix []byte
+	switch {
+	case p.len() == 0:
+		prefix = q.prefix()
+	case q.len() == 0:
+		prefix = p.prefix()
+	default:
+		prefix = commonPrefix(p.prefix(), q.prefix())
+	}
+	prefix = append([]byte(nil), prefix...)
+	var err error
+	if p, err = p.reformat(a, tag, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	q, err = q.reformat(a, tag, prefix)
+	return p, q, err
+}
+
+// commonPrefix returns the longest common prefix of a and b, but at most
+// kPrefix bytes of it.
+func commonPrefix(a, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && n < kPrefix && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
 // {p,left} dirty on exit
-func (p btreeDataPage) moveLeft(left btreeDataPage, n int) (btreeDataPage, btreeDataPage) {
+func (p btreeDataPage) moveLeft(a btreeStore, left btreeDataPage, n int) (btreeDataPage, btreeDataPage, error) {
+	p, left, err := p.unify(a, left)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	nl, np := left.len(), p.len()
 	left = left.setLen(nl + n)
 	left.copy(p, nl, 0, n)
 	p.copy(p, 0, n, np-n)
-	return p.setLen(np - n), left
+	return p.setLen(np - n), left, nil
 }
 
-func (p btreeDataPage) moveRight(right btreeDataPage, n int) (btreeDataPage, btreeDataPage) {
+func (p btreeDataPage) moveRight(a btreeStore, right btreeDataPage, n int) (btreeDataPage, btreeDataPage, error) {
+	p, right, err := p.unify(a, right)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	nr, np := right.len(), p.len()
 	right = right.setLen(nr + n)
 	right.copy(right, n, 0, nr)
 	right.copy(p, 0, np-n, n)
-	return p.setLen(np - n), right
+	return p.setLen(np - n), right, nil
 }
 
 func (p btreeDataPage) insertItem(a btreeStore, index int, key, value []byte) (btreeDataPage, error) {
+	if prefix := p.prefix(); !bytes.HasPrefix(key, prefix) {
+		var err error
+		if p, err = p.reformat(a, p[0], commonPrefix(prefix, key)); err != nil {
+			return nil, err
+		}
+	}
+
 	p = p.insert(index)
-	di, sz := 15+2*kKV*index, 2*kKV
+	di, sz := p.keyOff(index), 2*kKV
 	copy(p[di:di+sz], zeros[:sz])
 	if err := p.setKey(a, index, key); err != nil {
 		return nil, err
@@ -1444,6 +2389,10 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 
 	p.setNext(rh)
 	right.setPrev(ph)
+	if right, err = right.reformat(a, p[0], p.prefix()); err != nil {
+		return nil, err
+	}
+
 	right = right.setLen(kData)
 	right.copy(p, 0, kData, kData)
 	p = p.setLen(kData)
@@ -1461,7 +2410,7 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 		}
 
 	} else {
-		nr := newBTreeIndexPage(ph)
+		nr := newBTreeIndexPage(tagBTreeCountedIndexPage, ph)
 		defer bufs.GCache.Put(nr)
 		nr = nr.insert3(0, rh, rh)
 		nrh, err := a.Alloc(nr)
@@ -1469,7 +2418,7 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 			return nil, err
 		}
 
-		if err = a.Realloc(root, h2b(make([]byte, 7), nrh)); err != nil {
+		if err = btree(root).setRoot(a, nrh); err != nil {
 			return nil, err
 		}
 
@@ -1483,6 +2432,20 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 			return nil, err
 		}
 	}
+
+	tag, err := btree(root).dataPageTag(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if p, err = p.fit(a, tag); err != nil {
+		return nil, err
+	}
+
+	if right, err = right.fit(a, tag); err != nil {
+		return nil, err
+	}
+
 	if err = a.Realloc(ph, p); err != nil {
 		return nil, err
 	}
@@ -1505,7 +2468,10 @@ func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentInde
 
 		if left.len() < 2*kData {
 
-			p, left = p.moveLeft(left, 1)
+			if p, left, err = p.moveLeft(a, left, 1); err != nil {
+				return nil, err
+			}
+
 			if err = a.Realloc(leftH, left); err != nil {
 				return nil, err
 			}
@@ -1527,7 +2493,10 @@ func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentInde
 
 		if right.len() < 2*kData {
 			if index < 2*kData {
-				p, right = p.moveRight(right, 1)
+				if p, right, err = p.moveRight(a, right, 1); err != nil {
+					return nil, err
+				}
+
 				if err = a.Realloc(rightH, right); err != nil {
 					return nil, err
 				}
@@ -1566,7 +2535,7 @@ func (p btreeDataPage) swap(a btreeStore, di int, value []byte, canOverwrite boo
 type btreePage []byte
 
 func (p btreePage) isIndex() bool {
-	return p[0] == tagBTreeIndexPage
+	return p[0] == tagBTreeIndexPage || p[0] == tagBTreeCountedIndexPage
 }
 
 func (p btreePage) len() int {
@@ -1667,7 +2636,10 @@ func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, pa
 		}
 
 		if btreeDataPage(left).len()+p.len() >= 2*kData {
-			left, p = btreeDataPage(left).moveRight(p, 1)
+			if left, p, err = btreeDataPage(left).moveRight(a, p, 1); err != nil {
+				return err
+			}
+
 			if err = a.Realloc(lh, left); err != nil {
 				return err
 			}
@@ -1684,7 +2656,10 @@ func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, pa
 		}
 
 		if p.len()+btreeDataPage(right).len() > 2*kData {
-			right, p = btreeDataPage(right).moveLeft(p, 1)
+			if right, p, err = btreeDataPage(right).moveLeft(a, p, 1); err != nil {
+				return err
+			}
+
 			if err = a.Realloc(rh, right); err != nil {
 				return err
 			}
@@ -1718,7 +2693,10 @@ func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, p
 		return err
 	}
 
-	right, p = btreeDataPage(right).moveLeft(p, btreeDataPage(right).len())
+	if right, p, err = btreeDataPage(right).moveLeft(a, p, btreeDataPage(right).len()); err != nil {
+		return err
+	}
+
 	nxh := btreeDataPage(right).next()
 	if nxh != 0 {
 		nx := bufs.GCache.Get(maxBuf)
@@ -1761,8 +2739,7 @@ func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, p
 		return err
 	}
 
-	var b7 [7]byte
-	return a.Realloc(root, h2b(b7[:], ph))
+	return btree(root).setRoot(a, ph)
 }
 
 // external "root" is stable and contains the real root.
@@ -1773,26 +2750,90 @@ func newBTree(a btreeStore) (btree, error) {
 	return btree(r), err
 }
 
-func (root btree) String(a btreeStore) string {
-	r := bufs.GCache.Get(16)
-	defer bufs.GCache.Put(r)
-	r, err := a.Get(r, int64(root))
+// setRoot sets the root page of the tree to ph. The handle of the root page is
+// followed in the root block by the flags of the tree, if any, and by the name
+// of the tree's collation, if any, see CreateBTree. setRoot keeps them.
+func (root btree) setRoot(a btreeStore, ph int64) error {
+	b, err := a.Get(nil, int64(root))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	iroot := b2h(r)
-	m := map[int64]bool{int64(root): true}
+	return a.Realloc(int64(root), h2b(b, ph))
+}
 
-	s := []string{fmt.Sprintf("tree %#x -> %#x\n====", root, iroot)}
-	if iroot == 0 {
-		return s[0]
+// The flags of a tree are stored in the root block as a zero byte followed by
+// the flags byte. Collation names never start with a zero byte.
+
+// btreeRootFlags returns the flags recorded in the root block r.
+func btreeRootFlags(r []byte) byte {
+	if len(r) >= 9 && r[7] == 0 {
+		return r[8]
 	}
 
-	var f func(int64, string)
-	f = func(h int64, ind string) {
-		if m[h] {
-			return
+	return 0
+}
+
+// btreeRootName returns the collation name recorded in the root block r.
+func btreeRootName(r []byte) string {
+	if r = r[7:]; len(r) >= 2 && r[0] == 0 {
+		r = r[2:]
+	}
+	return string(r)
+}
+
+// btreeRootTag returns the format of the data pages created in the tree
+// having the root block r.
+func btreeRootTag(r []byte) byte {
+	if btreeRootFlags(r)&btreeFlagPrefix != 0 {
+		return tagBTreePrefixDataPage
+	}
+
+	return tagBTreeDataPage
+}
+
+func (root btree) dataPageTag(a btreeStore) (byte, error) {
+	r, err := a.Get(nil, int64(root))
+	if err != nil {
+		return 0, err
+	}
+
+	return btreeRootTag(r), nil
+}
+
+func (root btree) setFlags(a btreeStore, flags byte) error {
+	r, err := a.Get(nil, int64(root))
+	if err != nil {
+		return err
+	}
+
+	b := append(make([]byte, 0, len(r)+2), r[:7]...)
+	if flags != 0 {
+		b = append(b, 0, flags)
+	}
+	return a.Realloc(int64(root), append(b, btreeRootName(r)...))
+}
+
+func (root btree) String(a btreeStore) string {
+	r := bufs.GCache.Get(16)
+	defer bufs.GCache.Put(r)
+	r, err := a.Get(r, int64(root))
+	if err != nil {
+		panic(err)
+	}
+
+	iroot := b2h(r)
+	m := map[int64]bool{int64(root): true}
+
+	s := []string{fmt.Sprintf("tree %#x -> %#x\n====", root, iroot)}
+	if iroot == 0 {
+		return s[0]
+	}
+
+	var f func(int64, string)
+	f = func(h int64, ind string) {
+		if m[h] {
+			return
 		}
 
 		m[h] = true
@@ -1808,15 +2849,22 @@ func (root btree) String(a btreeStore) string {
 		case true:
 			da := []int64{}
 			b := btreeIndexPage(b)
+			n := func(i int) string {
+				if !b.counted() {
+					return ""
+				}
+
+				return fmt.Sprintf(" n[%d] %d", i, b.count(i))
+			}
 			for i := 0; i < b.len(); i++ {
 				c, d := b.child(i), b.dataPage(i)
-				s = append(s, fmt.Sprintf("%schild[%d] %#x dataPage[%d] %#x", ind, i, c, i, d))
+				s = append(s, fmt.Sprintf("%schild[%d] %#x%s dataPage[%d] %#x", ind, i, c, n(i), i, d))
 				da = append(da, c)
 				da = append(da, d)
 			}
 			i := b.len()
 			c := b.child(i)
-			s = append(s, fmt.Sprintf("%schild[%d] %#x", ind, i, c))
+			s = append(s, fmt.Sprintf("%schild[%d] %#x%s", ind, i, c, n(i)))
 			for _, c := range da {
 				f(c, ind+"  ")
 			}
@@ -1824,6 +2872,9 @@ func (root btree) String(a btreeStore) string {
 		case false:
 			b := btreeDataPage(b)
 			s = append(s, fmt.Sprintf("%sprev %#x next %#x", ind, b.prev(), b.next()))
+			if b[0] == tagBTreePrefixDataPage {
+				s = append(s, fmt.Sprintf("%sprefix|% x|", ind, b.prefix()))
+			}
 			for i := 0; i < b.len(); i++ {
 				k, err := b.key(a, i)
 				if err != nil {
@@ -1871,17 +2922,22 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 			return
 		}
 
+		if p, err = p.fit(a, btreeRootTag(r)); err != nil {
+			return
+		}
+
 		h, err = a.Alloc(p)
 		if err != nil {
 			return nil, true, err
 		}
 
-		err = a.Realloc(int64(root), h2b(r, h)[:7])
+		err = root.setRoot(a, h)
 		return
 	}
 
 	parentIndex := -1
 	var parent int64
+	var path []btreeStep
 	ph := iroot
 
 	p := bufs.GCache.Get(maxBuf)
@@ -1939,12 +2995,18 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 			return
 		case btreePage(p).isIndex():
 			if btreePage(p).len() > 2*kIndex {
+				h := ph
 				if p, err = btreeIndexPage(p).split(a, root, &ph, parent, parentIndex, &index); err != nil {
 					return
 				}
+
+				if ph != h && len(path) != 0 { // Continuing in the new right sibling.
+					path[len(path)-1].index++
+				}
 			}
 			parentIndex = index
 			parent = ph
+			path = append(path, btreeStep{ph, index})
 			ph = btreeIndexPage(p).child(index)
 		default:
 			if value, written, err = upd(key, nil); err != nil || !written {
@@ -1956,39 +3018,53 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 					return
 				}
 
-				err = a.Realloc(ph, p)
+				if err = a.Realloc(ph, p); err != nil {
+					return
+				}
+
+				err = root.recount(a, c, key, path, 1)
 				return
 			}
 
 			// page is full
-			p, err = btreeDataPage(p).overflow(a, int64(root), ph, parent, parentIndex, index, key, value)
+			if p, err = btreeDataPage(p).overflow(a, int64(root), ph, parent, parentIndex, index, key, value); err != nil {
+				return
+			}
+
+			err = root.recount(a, c, key, path, 0)
 			return
 		}
 	}
 }
 
-//TODO actually use 'dst' to return 'value'
 func (root btree) get(a btreeStore, dst []byte, c func(a, b []byte) int, key []byte) (b []byte, err error) {
+	p, index, ok, err := root.lookup(a, dst, c, key)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	return p.value(a, index)
+}
+
+// lookup returns the data page containing key and the index of key in it. The
+// pages are read into buf.
+func (root btree) lookup(a btreeStore, buf []byte, c func(a, b []byte) int, key []byte) (dp btreeDataPage, index int, ok bool, err error) {
 	var r []byte
-	if r, err = a.Get(dst, int64(root)); err != nil {
+	if r, err = a.Get(buf, int64(root)); err != nil {
 		return
 	}
 
-	iroot := b2h(r)
-	if iroot == 0 {
+	ph := b2h(r)
+	if ph == 0 {
 		return
 	}
 
-	ph := iroot
-
 	for {
 		var p btreePage
-		if p, err = a.Get(p, ph); err != nil {
+		if p, err = a.Get(buf, ph); err != nil {
 			return
 		}
 
-		var index int
-		var ok bool
 		if index, ok, err = p.find(a, c, key); err != nil {
 			return
 		}
@@ -1996,20 +3072,18 @@ func (root btree) get(a btreeStore, dst []byte, c func(a, b []byte) int, key []b
 		switch {
 		case ok:
 			if p.isIndex() {
-				dh := btreeIndexPage(p).dataPage(index)
-				dp, err := a.Get(dst, dh)
-				if err != nil {
-					return nil, err
+				if p, err = a.Get(buf, btreeIndexPage(p).dataPage(index)); err != nil {
+					return nil, 0, false, err
 				}
 
-				return btreeDataPage(dp).value(a, 0)
+				return btreeDataPage(p), 0, true, nil
 			}
 
-			return btreeDataPage(p).value(a, index)
+			return btreeDataPage(p), index, true, nil
 		case p.isIndex():
 			ph = btreeIndexPage(p).child(index)
 		default:
-			return
+			return nil, 0, false, nil
 		}
 	}
 }
@@ -2029,6 +3103,7 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 	ph := iroot
 	parentIndex := -1
 	var parent int64
+	var path []btreeStep
 
 	p := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(p)
@@ -2052,7 +3127,7 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 					return nil, err
 				}
 
-				if btreeDataPage(dp).len() > kData {
+				if btreeDataPage(dp).len() > kData && !btreeIndexPage(p).counted() {
 					if dp, value, err = btreeDataPage(dp).extract(a, 0); err != nil {
 						return nil, err
 					}
@@ -2061,37 +3136,51 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 				}
 
 				if btreeIndexPage(p).len() < kIndex && ph != iroot {
+					h := ph
 					var err error
 					if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
 						return nil, err
 					}
+
+					if ph != h { // Concatenated into the left sibling.
+						path[len(path)-1].index--
+					}
 				}
 				parentIndex = index + 1
 				parent = ph
+				path = append(path, btreeStep{ph, parentIndex})
 				ph = btreeIndexPage(p).child(parentIndex)
 				continue
 			}
 
 			p, value, err = btreeDataPage(p).extract(a, index)
-			if btreePage(p).len() >= kData {
-				err = a.Realloc(ph, p)
+			if err != nil {
 				return
 			}
 
-			if ph != iroot {
+			delta := 0
+			switch {
+			case btreePage(p).len() >= kData:
+				err = a.Realloc(ph, p)
+				delta = -1
+			case ph != iroot:
 				err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex)
-				return
-			}
-
-			if btreePage(p).len() == 0 {
+			case btreePage(p).len() == 0:
 				if err = a.Free(ph); err != nil {
 					return
 				}
 
-				err = a.Realloc(int64(root), zeros[:7])
+				err = root.setRoot(a, 0)
+				return
+			default:
+				err = a.Realloc(ph, p)
 				return
 			}
-			err = a.Realloc(ph, p)
+			if err != nil {
+				return
+			}
+
+			err = root.recount(a, c, key, path, delta)
 			return
 		}
 
@@ -2100,12 +3189,18 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 		}
 
 		if btreePage(p).len() < kIndex && ph != iroot {
+			h := ph
 			if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
 				return nil, err
 			}
+
+			if ph != h { // Concatenated into the left sibling.
+				path[len(path)-1].index--
+			}
 		}
 		parentIndex = index
 		parent = ph
+		path = append(path, btreeStep{ph, index})
 		ph = btreeIndexPage(p).child(index)
 	}
 }
@@ -2126,6 +3221,7 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 	ph := iroot
 	parentIndex := -1
 	var parent int64
+	var path []btreeStep
 	p := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(p)
 
@@ -2143,7 +3239,7 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 				return false, err
 			}
 
-			if btreeDataPage(dp).len() > kData {
+			if btreeDataPage(dp).len() > kData && !btreeIndexPage(p).counted() {
 				if dp, _, err = btreeDataPage(dp).extract(a, 0); err != nil {
 					return false, err
 				}
@@ -2152,36 +3248,47 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 			}
 
 			if btreeIndexPage(p).len() < kIndex && ph != iroot {
+				h := ph
 				if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
 					return false, err
 				}
+
+				if ph != h { // Concatenated into the left sibling.
+					path[len(path)-1].index--
+				}
 			}
 			parentIndex = index + 1
 			parent = ph
+			path = append(path, btreeStep{ph, parentIndex})
 			ph = btreeIndexPage(p).child(parentIndex)
 			continue
 		}
 
-		p, _, err = btreeDataPage(p).extract(a, index)
-		if btreePage(p).len() >= kData {
-			err = a.Realloc(ph, p)
+		if p, _, err = btreeDataPage(p).extract(a, index); err != nil {
 			return false, err
 		}
 
-		if ph != iroot {
+		delta := 0
+		switch {
+		case btreePage(p).len() >= kData:
+			err = a.Realloc(ph, p)
+			delta = -1
+		case ph != iroot:
 			err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex)
-			return false, err
-		}
-
-		if btreePage(p).len() == 0 {
+		case btreePage(p).len() == 0:
 			if err = a.Free(ph); err != nil {
 				return true, err
 			}
 
-			return true, a.Realloc(int64(root), zeros[:7])
+			return true, root.setRoot(a, 0)
+		default:
+			return false, a.Realloc(ph, p)
+		}
+		if err != nil {
+			return false, err
 		}
 
-		return false, a.Realloc(ph, p)
+		return false, root.recount(a, nil, nil, path, delta)
 	}
 }
 
@@ -2275,8 +3382,7 @@ func (root btree) clear(a btreeStore) (err error) {
 		return
 	}
 
-	var b [7]byte
-	return a.Realloc(int64(root), b[:])
+	return root.setRoot(a, 0)
 }
 
 func (root btree) clear2(a btreeStore, ph int64) (err error) {
@@ -2296,7 +3402,7 @@ func (root btree) clear2(a btreeStore, ph int64) (err error) {
 	case false:
 		dp := btreeDataPage(p)
 		for i := 0; i < dp.len(); i++ {
-			if err = dp.setKey(a, i, nil); err != nil {
+			if err = dp.setContent(a, dp.keyOff(i), nil); err != nil {
 				return
 			}
 
@@ -2307,3 +3413,1225 @@ func (root btree) clear2(a btreeStore, ph int64) (err error) {
 	}
 	return a.Free(ph)
 }
+
+// rehandle replaces the moved handles in the root block and in all pages of
+// the tree.
+func (root btree) rehandle(a btreeStore, moved map[int64]int64) (err error) {
+	r, err := a.Get(nil, int64(root))
+	if err != nil {
+		return
+	}
+
+	ph := b2h(r)
+	if ph == 0 {
+		return
+	}
+
+	if h, ok := moved[ph]; ok {
+		ph = h
+		if err = a.Realloc(int64(root), h2b(r, ph)); err != nil {
+			return
+		}
+	}
+
+	return root.rehandle2(a, moved, ph)
+}
+
+func (root btree) rehandle2(a btreeStore, moved map[int64]int64, ph int64) (err error) {
+	p, err := a.Get(nil, ph)
+	if err != nil {
+		return
+	}
+
+	var dirty bool
+	field := func(off int) {
+		if h, ok := moved[b2h(p[off:])]; ok {
+			h2b(p[off:], h)
+			dirty = true
+		}
+	}
+	var children []int64
+	switch btreePage(p).isIndex() {
+	case true:
+		ip := btreeIndexPage(p)
+		for i := 0; i <= ip.len(); i++ {
+			field(ip.off(i))
+			if i < ip.len() {
+				field(ip.off(i) + ip.w())
+			}
+			children = append(children, ip.child(i))
+		}
+	case false:
+		dp := btreeDataPage(p)
+		field(1)
+		field(8)
+		for i := 0; i < dp.len(); i++ {
+			for _, off := range []int{dp.keyOff(i), dp.keyOff(i) + kKV} {
+				if dp[off] >= kKV {
+					field(off + kH)
+				}
+			}
+		}
+	}
+	if dirty {
+		if err = a.Realloc(ph, p); err != nil {
+			return
+		}
+	}
+
+	for _, h := range children {
+		if err = root.rehandle2(a, moved, h); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// btreeRange is the state of a deleteRange in progress.
+type btreeRange struct {
+	c        func(a, b []byte) int
+	from, to []byte
+	next     int64 // Data page following the range.
+	prev     int64 // Data page preceding the range.
+	seen     bool  // The first data page of the range was visited.
+}
+
+// bounds returns the indexes of the first and the last child of the index
+// page p, or the indexes of the first and past the last item of the data page
+// p, within the range.
+func (r *btreeRange) bounds(a btreeStore, p btreePage) (i0, i1 int, err error) {
+	i1 = p.len()
+	if r.from != nil {
+		if i0, err = r.find(a, p, r.from); err != nil {
+			return
+		}
+	}
+
+	if r.to != nil {
+		i1, err = r.find(a, p, r.to)
+	}
+	return
+}
+
+func (r *btreeRange) find(a btreeStore, p btreePage, key []byte) (int, error) {
+	index, ok, err := p.find(a, r.c, key)
+	if ok && p.isIndex() {
+		index++
+	}
+	return index, err
+}
+
+func (root btree) deleteRange(a btreeStore, c func(a, b []byte) int, from, to []byte) (err error) {
+	if c == nil {
+		c = bytes.Compare
+	}
+
+	if from != nil && to != nil && c(from, to) >= 0 {
+		return
+	}
+
+	first, _, err := root.first(a)
+	if err != nil || first == 0 {
+		return
+	}
+
+	rb := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(rb)
+	if rb, err = a.Get(rb, int64(root)); err != nil {
+		return
+	}
+
+	r := &btreeRange{c: c, from: from, to: to}
+	if first, _, err = root.deleteRange2(a, r, b2h(rb), first); err != nil {
+		return
+	}
+
+	if first == 0 {
+		return root.setRoot(a, 0)
+	}
+
+	if r.prev == r.next {
+		return root.rebalance(a, c, from)
+	}
+
+	// Link the data pages around the range.
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	if r.prev != 0 {
+		if p, err = a.Get(p, r.prev); err != nil {
+			return
+		}
+
+		btreeDataPage(p).setNext(r.next)
+		if err = a.Realloc(r.prev, p); err != nil {
+			return
+		}
+	}
+
+	var next []byte
+	if r.next != 0 {
+		if p, err = a.Get(p, r.next); err != nil {
+			return
+		}
+
+		if next, err = btreeDataPage(p).key(a, 0); err != nil {
+			return
+		}
+
+		btreeDataPage(p).setPrev(r.prev)
+		if err = a.Realloc(r.next, p); err != nil {
+			return
+		}
+	}
+
+	if r.prev != 0 {
+		if err = root.rebalance(a, c, from); err != nil {
+			return
+		}
+	}
+
+	if r.next != 0 {
+		err = root.rebalance(a, c, next)
+	}
+	return
+}
+
+// deleteRange2 deletes the items within r from the subtree ph, having the
+// leftmost data page first. It returns the leftmost data page of what remains
+// of the subtree or zero if the subtree was deleted completely and the number
+// of KV pairs remaining in the subtree. deleteRange2 leaves the pages on the paths to the range boundaries possibly underflowed
+// and it does not link the data pages around the range.
+func (root btree) deleteRange2(a btreeStore, r *btreeRange, ph, first int64) (int64, int64, error) {
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	p, err := a.Get(p, ph)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	i0, i1, err := r.bounds(a, p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !btreePage(p).isIndex() {
+		dp := btreeDataPage(p)
+		n := dp.len()
+		if !r.seen {
+			r.seen = true
+			r.prev = ph
+			if i0 == 0 {
+				r.prev = dp.prev()
+			}
+		}
+		r.next = ph
+		if i1 == n {
+			r.next = dp.next()
+		}
+		if i0 == i1 {
+			return first, int64(n), nil
+		}
+
+		for i := i0; i < i1; i++ {
+			if _, h := dp.keyField(i); h != 0 {
+				if err = a.Free(h); err != nil {
+					return 0, 0, err
+				}
+			}
+
+			if _, h := dp.valueField(i); h != 0 {
+				if err = a.Free(h); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+		if i1-i0 == n {
+			return 0, 0, a.Free(ph)
+		}
+
+		n -= i1 - i0
+		dp.copy(dp, i0, i1, n-i0)
+		return first, int64(n), a.Realloc(ph, dp.setLen(n))
+	}
+
+	ip := btreeIndexPage(p)
+	n := ip.len()
+	children := make([]int64, 0, n+1)
+	firsts := make([]int64, 0, n+1)
+	counts := make([]int64, 0, n+1)
+	var sum int64
+	for i := 0; i <= n; i++ {
+		ch, f, c := ip.child(i), first, ip.count(i)
+		if i > 0 {
+			f = ip.dataPage(i - 1)
+		}
+		switch {
+		case i > i0 && i < i1: // Entirely within the range.
+			if err = root.clear2(a, ch); err != nil {
+				return 0, 0, err
+			}
+
+			continue
+		case i == i0 || i == i1:
+			if f, c, err = root.deleteRange2(a, r, ch, f); err != nil {
+				return 0, 0, err
+			}
+
+			if f == 0 {
+				continue
+			}
+		}
+		children = append(children, ch)
+		firsts = append(firsts, f)
+		counts = append(counts, c)
+		sum += c
+	}
+	if len(children) == 0 {
+		return 0, 0, a.Free(ph)
+	}
+
+	ip = ip.setLen(len(children) - 1)
+	ip.setChild(0, children[0])
+	ip.setCount(0, counts[0])
+	for i := 1; i < len(children); i++ {
+		ip.setDataPage(i-1, firsts[i])
+		ip.setChild(i, children[i])
+		ip.setCount(i, counts[i])
+	}
+	return firsts[0], sum, a.Realloc(ph, ip)
+}
+
+// rebalance fixes the underflowed pages on the path to key and replaces root
+// index pages having a single child with that child.
+func (root btree) rebalance(a btreeStore, c func(a, b []byte) int, key []byte) (err error) {
+	r := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	iroot := b2h(r)
+	for ph := iroot; ph != 0; {
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		if !btreePage(p).isIndex() {
+			return
+		}
+
+		var index int
+		for {
+			var ok bool
+			if index, ok, err = btreePage(p).find(a, c, key); err != nil {
+				return
+			}
+
+			if ok {
+				index++
+			}
+			if btreeIndexPage(p).len() == 0 {
+				break
+			}
+
+			if ok, err = underflowed(a, btreeIndexPage(p).child(index)); err != nil || !ok {
+				break
+			}
+
+			if p, err = btreeIndexPage(p).balance(a, ph, index); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		ch := btreeIndexPage(p).child(index)
+		if ph == iroot && btreeIndexPage(p).len() == 0 {
+			if err = a.Free(ph); err != nil {
+				return
+			}
+
+			if err = root.setRoot(a, ch); err != nil {
+				return
+			}
+
+			iroot = ch
+		}
+		ph = ch
+	}
+	return
+}
+
+func underflowed(a btreeStore, ph int64) (bool, error) {
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	p, err := a.Get(p, ph)
+	if err != nil {
+		return false, err
+	}
+
+	if btreePage(p).isIndex() {
+		return btreeIndexPage(p).len() < kIndex, nil
+	}
+
+	return btreeDataPage(p).len() < kData, nil
+}
+
+// balance concatenates the child at index of p, having handle ph, with its
+// sibling or it moves items between them until neither of them underflows. It
+// returns the updated p. balance must persist all changes made.
+func (p btreeIndexPage) balance(a btreeStore, ph int64, index int) (btreeIndexPage, error) {
+	if index == p.len() {
+		index--
+	}
+	lh, rh := p.child(index), p.child(index+1)
+	left := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(left)
+	left, err := a.Get(left, lh)
+	if err != nil {
+		return nil, err
+	}
+
+	right := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(right)
+	if right, err = a.Get(right, rh); err != nil {
+		return nil, err
+	}
+
+	if btreePage(left).isIndex() {
+		var b btreeIndexPage = bufs.GCache.Get(maxBuf)
+		defer bufs.GCache.Put(b)
+		b = append(b[:1], left[1:]...)
+		b[0] = left[0]
+		o := p.off(index) + p.w()
+		b = append(b, p[o:o+7]...)
+		b = append(b, right[1:]...)
+		n := b.len()
+		if n <= 2*kIndex {
+			if err = a.Realloc(lh, b); err != nil {
+				return nil, err
+			}
+
+			if err = a.Free(rh); err != nil {
+				return nil, err
+			}
+
+			c := p.sum(index, index+2)
+			p = p.extract(index)
+			p.setChild(index, lh)
+			p.setCount(index, c)
+			return p, a.Realloc(ph, p)
+		}
+
+		k := n / 2
+		p.setDataPage(index, b.dataPage(k))
+		p.setCount(index, b.sum(0, k+1))
+		p.setCount(index+1, b.sum(k+1, n+1))
+		right = append(right[:1], b[b.off(k+1):]...)
+		if err = a.Realloc(lh, b[:b.off(k)+b.w()]); err != nil {
+			return nil, err
+		}
+
+		if err = a.Realloc(rh, right); err != nil {
+			return nil, err
+		}
+
+		return p, a.Realloc(ph, p)
+	}
+
+	nl, nr := btreeDataPage(left).len(), btreeDataPage(right).len()
+	if nl+nr <= 2*kData {
+		if right, left, err = btreeDataPage(right).moveLeft(a, left, nr); err != nil {
+			return nil, err
+		}
+
+		if nxh := btreeDataPage(right).next(); nxh != 0 {
+			nx := bufs.GCache.Get(maxBuf)
+			defer bufs.GCache.Put(nx)
+			if nx, err = a.Get(nx, nxh); err != nil {
+				return nil, err
+			}
+
+			btreeDataPage(nx).setPrev(lh)
+			if err = a.Realloc(nxh, nx); err != nil {
+				return nil, err
+			}
+		}
+		btreeDataPage(left).setNext(btreeDataPage(right).next())
+		if err = a.Realloc(lh, left); err != nil {
+			return nil, err
+		}
+
+		if err = a.Free(rh); err != nil {
+			return nil, err
+		}
+
+		p = p.extract(index)
+		p.setChild(index, lh)
+		p.setCount(index, int64(nl+nr))
+		return p, a.Realloc(ph, p)
+	}
+
+	switch half := (nl + nr) / 2; {
+	case nl > half:
+		left, right, err = btreeDataPage(left).moveRight(a, right, nl-half)
+	default:
+		right, left, err = btreeDataPage(right).moveLeft(a, left, half-nl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.setCount(index, int64(btreeDataPage(left).len()))
+	p.setCount(index+1, int64(btreeDataPage(right).len()))
+	if err = a.Realloc(ph, p); err != nil {
+		return nil, err
+	}
+
+	if err = a.Realloc(lh, left); err != nil {
+		return nil, err
+	}
+
+	return p, a.Realloc(rh, right)
+}
+
+// load fills the empty tree with the KV pairs returned by next, see
+// CreateBTreeFromSorted. The tree is cleared on error.
+func (root btree) load(a btreeStore, c func(a, b []byte) int, next func() (k, v []byte, err error)) (err error) {
+	if c == nil {
+		c = bytes.Compare
+	}
+
+	tag, err := root.dataPageTag(a)
+	if err != nil {
+		return
+	}
+
+	l := newBTreeLoader(a, tag)
+	var last []byte
+	for n := 0; ; n++ {
+		k, v, err := next()
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil && n != 0 && c(last, k) >= 0 {
+			err = &ErrINVAL{"BTree: key out of order", k}
+		}
+		if err == nil {
+			err = l.put(k, v)
+		}
+		if err != nil {
+			if h, err2 := l.finish(); err2 == nil && h != 0 {
+				if root.setRoot(a, h) == nil {
+					root.clear(a)
+				}
+			}
+			return err
+		}
+
+		last = append(last[:0], k...)
+	}
+
+	h, err := l.finish()
+	if err != nil || h == 0 {
+		return
+	}
+
+	return root.setRoot(a, h)
+}
+
+// btreeChild is a child of an index page being built by btreeLoader.
+type btreeChild struct {
+	h     int64 // Child page.
+	first int64 // Leftmost data page of the child.
+	n     int64 // Number of KV pairs in the child's subtree.
+}
+
+// btreeLevel holds the children of the index pages of one tree level, which
+// were not yet allocated.
+type btreeLevel struct {
+	cur  []btreeChild // Index page being filled.
+	pend []btreeChild // Full index page preceding cur.
+}
+
+// btreeLoader builds a btree bottom-up from sorted KV pairs. The full index
+// page preceding the last one of every level is allocated only when the
+// next one fills up, so that the last two can be balanced in finish. Data
+// pages are allocated when full, the previous one is then updated to link to
+// the new one.
+type btreeLoader struct {
+	a      btreeStore
+	tag    byte          // Data page format.
+	dp     btreeDataPage // Data page being filled.
+	lp     btreeDataPage // Last allocated data page.
+	lh     int64         // Handle of lp.
+	levels []btreeLevel  // Index levels, bottom-up.
+}
+
+func newBTreeLoader(a btreeStore, tag byte) *btreeLoader {
+	l := &btreeLoader{a: a, tag: tag}
+	for _, p := range []*btreeDataPage{&l.dp, &l.lp} {
+		// Full pages must not fill the capacity, memBTreeStore would
+		// not copy them, see bpack.
+		*p = make(btreeDataPage, 15, 16+kPrefix+(2*kData+1)*2*kKV)
+		(*p)[0] = tagBTreeDataPage
+	}
+	return l
+}
+
+func (l *btreeLoader) put(k, v []byte) (err error) {
+	if l.dp.len() == 2*kData {
+		if err = l.flush(); err != nil {
+			return
+		}
+	}
+
+	if l.dp.len() == 0 {
+		// The prefix of a compressed page starts as the whole first
+		// key, insertItem shrinks it to the prefix common to all keys.
+		if l.dp, err = l.dp.reformat(l.a, l.tag, commonPrefix(k, k)); err != nil {
+			return
+		}
+	}
+
+	l.dp, err = l.dp.insertItem(l.a, l.dp.len(), k, v)
+	return
+}
+
+// flush allocates the data page being filled.
+func (l *btreeLoader) flush() error {
+	l.dp.setPrev(l.lh)
+	h, err := l.a.Alloc(l.dp)
+	if err != nil {
+		return err
+	}
+
+	if l.lh != 0 {
+		l.lp.setNext(h)
+		if err = l.a.Realloc(l.lh, l.lp); err != nil {
+			return err
+		}
+	}
+
+	n := int64(l.dp.len())
+	l.dp, l.lp, l.lh = l.lp[:15], l.dp, h
+	l.dp[0] = tagBTreeDataPage
+	l.dp.setNext(0)
+	return l.push(0, h, h, n)
+}
+
+// push adds the child page h, having the leftmost data page first and n KV
+// pairs, to the index page being filled at level.
+func (l *btreeLoader) push(level int, h, first, n int64) error {
+	if level == len(l.levels) {
+		l.levels = append(l.levels, btreeLevel{})
+	}
+	v := &l.levels[level]
+	if len(v.cur) == 2*kIndex+1 {
+		if v.pend != nil {
+			if err := l.flushIndex(level+1, v.pend); err != nil {
+				return err
+			}
+
+			v = &l.levels[level] // flushIndex may have appended to l.levels.
+		}
+		v.pend, v.cur = v.cur, v.pend[:0]
+	}
+	v.cur = append(v.cur, btreeChild{h, first, n})
+	return nil
+}
+
+// flushIndex allocates an index page with children and pushes it to level.
+func (l *btreeLoader) flushIndex(level int, children []btreeChild) error {
+	p := newBTreeIndexPage(tagBTreeCountedIndexPage, children[0].h)
+	defer bufs.GCache.Put(p)
+	p = p.setLen(len(children) - 1)
+	n := children[0].n
+	p.setCount(0, n)
+	for i, c := range children[1:] {
+		p.setDataPage(i, c.first)
+		p.setChild(i+1, c.h)
+		p.setCount(i+1, c.n)
+		n += c.n
+	}
+	h, err := l.a.Alloc(p)
+	if err != nil {
+		return err
+	}
+
+	return l.push(level, h, children[0].first, n)
+}
+
+// finish allocates the remaining pages. It returns the root page of the tree
+// or zero if the tree is empty.
+func (l *btreeLoader) finish() (int64, error) {
+	if n := l.dp.len(); n != 0 {
+		if l.lh != 0 && n < kData { // Do not leave the last data page underflowed.
+			var err error
+			if l.lp, l.dp, err = l.lp.moveRight(l.a, l.dp, kData-n); err != nil {
+				return 0, err
+			}
+
+			v := l.levels[0].cur
+			v[len(v)-1].n = int64(l.lp.len())
+		}
+		if err := l.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	for level := 0; level < len(l.levels); level++ {
+		v := l.levels[level]
+		if v.pend == nil {
+			if len(v.cur) == 1 {
+				return v.cur[0].h, nil
+			}
+
+			if err := l.flushIndex(level+1, v.cur); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		if len(v.cur) < kIndex { // Do not leave the last index page underflowed.
+			all := append(append([]btreeChild(nil), v.pend...), v.cur...)
+			k := len(all) - len(all)/2
+			v.pend, v.cur = all[:k], all[k:]
+		}
+		if err := l.flushIndex(level+1, v.pend); err != nil {
+			return 0, err
+		}
+
+		if err := l.flushIndex(level+1, v.cur); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// btreeStep is an index page on the path to a KV pair and the index of the
+// child the path continues to.
+type btreeStep struct {
+	ph    int64
+	index int
+}
+
+// recount updates the counts of the index pages on path, the path to key, after
+// a KV pair was inserted or deleted. If no data page was split, concatenated
+// or balanced against a sibling, delta is the change of the number of KV pairs
+// and the counts of the children on path are adjusted by delta. Otherwise
+// delta is zero and the counts are recomputed. The data page operations can
+// shift the child the path continues to by one, the counts of its siblings are
+// thus recomputed as well.
+func (root btree) recount(a btreeStore, c func(a, b []byte) int, key []byte, path []btreeStep, delta int) (err error) {
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	if p, err = a.Get(p, int64(root)); err != nil {
+		return
+	}
+
+	// The root may have been split or collapsed after path was recorded.
+	var head []btreeStep
+	for ph := b2h(p); ; {
+		i := 0
+		for i < len(path) && path[i].ph != ph {
+			i++
+		}
+		if i < len(path) {
+			path = append(head, path[i:]...)
+			break
+		}
+
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		if !btreePage(p).isIndex() {
+			path = head
+			break
+		}
+
+		index, ok, err := btreePage(p).find(a, c, key)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			index++
+		}
+		head = append(head, btreeStep{ph, index})
+		ph = btreeIndexPage(p).child(index)
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		s := path[i]
+		if p, err = a.Get(p, s.ph); err != nil {
+			return
+		}
+
+		q := btreeIndexPage(p)
+		if !q.counted() {
+			return
+		}
+
+		if delta != 0 {
+			q.setCount(s.index, q.count(s.index)+int64(delta))
+			if err = a.Realloc(s.ph, q); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		j := s.index - 1
+		if j < 0 {
+			j = 0
+		}
+		for ; j <= s.index+1 && j <= q.len(); j++ {
+			n, err := btreeLen(a, q.child(j))
+			if err != nil {
+				return err
+			}
+
+			q.setCount(j, n)
+		}
+		if err = a.Realloc(s.ph, q); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// btreeLen returns the number of KV pairs in the subtree ph.
+func btreeLen(a btreeStore, ph int64) (n int64, err error) {
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	if p, err = a.Get(p, ph); err != nil {
+		return
+	}
+
+	if !btreePage(p).isIndex() {
+		return int64(btreeDataPage(p).len()), nil
+	}
+
+	q := btreeIndexPage(p)
+	for i := 0; i <= q.len(); i++ {
+		m, err := q.subtreeLen(a, i)
+		if err != nil {
+			return 0, err
+		}
+
+		n += m
+	}
+	return
+}
+
+// subtreeLen returns the number of KV pairs in the subtree of the child at
+// index. It walks the subtree if p is not counted.
+func (p btreeIndexPage) subtreeLen(a btreeStore, index int) (int64, error) {
+	if p.counted() {
+		return p.count(index), nil
+	}
+
+	return btreeLen(a, p.child(index))
+}
+
+func (root btree) len(a btreeStore) (n int64, err error) {
+	r := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	if iroot := b2h(r); iroot != 0 {
+		return btreeLen(a, iroot)
+	}
+
+	return
+}
+
+func (root btree) rank(a btreeStore, c func(a, b []byte) int, key []byte) (n int64, err error) {
+	r := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	for ph := b2h(r); ph != 0; {
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		index, ok, err := btreePage(p).find(a, c, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !btreePage(p).isIndex() {
+			return n + int64(index), nil
+		}
+
+		if ok {
+			index++
+		}
+		q := btreeIndexPage(p)
+		for i := 0; i < index; i++ {
+			m, err := q.subtreeLen(a, i)
+			if err != nil {
+				return 0, err
+			}
+
+			n += m
+		}
+		ph = q.child(index)
+	}
+	return
+}
+
+func (root btree) nth(a btreeStore, index int64) (key, value []byte, err error) {
+	if index < 0 {
+		return nil, nil, &ErrINVAL{"BTree.Nth: index out of range", index}
+	}
+
+	r := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	i := index
+	for ph := b2h(r); ph != 0; {
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		if !btreePage(p).isIndex() {
+			dp := btreeDataPage(p)
+			if i >= int64(dp.len()) {
+				break
+			}
+
+			if key, err = dp.key(a, int(i)); err != nil {
+				return
+			}
+
+			key = append([]byte(nil), key...)
+			value, err = dp.valueCopy(a, int(i))
+			return
+		}
+
+		q := btreeIndexPage(p)
+		j := 0
+		for ; j < q.len(); j++ {
+			n, err := q.subtreeLen(a, j)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if i < n {
+				break
+			}
+
+			i -= n
+		}
+		ph = q.child(j)
+	}
+	return nil, nil, &ErrINVAL{"BTree.Nth: index out of range", index}
+}
+
+func (root btree) stats(a btreeStore) (st BTreeStats, err error) {
+	r, err := a.Get(nil, int64(root))
+	if err != nil {
+		return
+	}
+
+	var f func(ph int64, d int) error
+	f = func(ph int64, d int) error {
+		p, err := a.Get(nil, ph)
+		if err != nil {
+			return err
+		}
+
+		if btreePage(p).isIndex() {
+			st.IndexPages++
+			q := btreeIndexPage(p)
+			for i := 0; i <= q.len(); i++ {
+				if err = f(q.child(i), d+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		st.DataPages++
+		st.Depth = d + 1
+		q := btreeDataPage(p)
+		for i := 0; i < q.len(); i++ {
+			key, err := q.key(a, i)
+			if err != nil {
+				return err
+			}
+
+			value, err := q.value(a, i)
+			if err != nil {
+				return err
+			}
+
+			st.item(q, q.keyOff(i), len(key), len(value))
+		}
+		st.Items += int64(q.len())
+		return nil
+	}
+
+	if ph := b2h(r); ph != 0 {
+		if err = f(ph, 0); err != nil {
+			return
+		}
+	}
+
+	st.fill()
+	return
+}
+
+type btreeVerifier struct {
+	a       btreeStore
+	c       func(a, b []byte) int
+	log     func(error) bool
+	err     error // First problem reported.
+	st      BTreeStats
+	pages   map[int64]bool // Pages already visited.
+	depth   int            // Depth of the data pages, -1 if not yet known.
+	tag     int            // Tag of the index pages, -1 if not yet known.
+	prev    int64          // Last data page visited.
+	next    int64          // Next link of the last data page visited.
+	lastKey []byte
+}
+
+func (root btree) verify(a btreeStore, c func(a, b []byte) int, log func(error) bool) (st BTreeStats, err error) {
+	r, err := a.Get(nil, int64(root))
+	if err != nil {
+		return
+	}
+
+	if len(r) < 7 {
+		err = &ErrILSEQ{Type: ErrBTree, Off: h2off(int64(root)), More: fmt.Sprintf("invalid root block size %d", len(r))}
+		log(err)
+		return
+	}
+
+	if c == nil {
+		c = bytes.Compare
+	}
+	v := &btreeVerifier{a: a, c: c, log: log, pages: map[int64]bool{}, depth: -1, tag: -1}
+	if ph := b2h(r); ph != 0 {
+		if _, _, err = v.page(ph, 0); err != nil {
+			return
+		}
+
+		if v.next != 0 {
+			if err = v.report(v.prev, "last data page has next %#x", v.next); err != nil {
+				return
+			}
+		}
+
+		v.st.Depth = v.depth + 1
+	}
+	v.st.fill()
+	return v.st, v.err
+}
+
+// report passes a problem of the page ph to log. It returns a non nil error
+// if the verification must stop.
+func (v *btreeVerifier) report(ph int64, format string, arg ...interface{}) error {
+	err := &ErrILSEQ{Type: ErrBTree, Off: h2off(ph), More: fmt.Sprintf(format, arg...)}
+	if v.err == nil {
+		v.err = err
+	}
+	if !v.log(err) {
+		return err
+	}
+
+	return nil
+}
+
+// page verifies the subtree of the page ph at depth d. It returns the handle
+// of the subtree's first data page and the number of KV pairs in the subtree.
+func (v *btreeVerifier) page(ph int64, d int) (first, n int64, err error) {
+	if v.pages[ph] {
+		return 0, 0, v.report(ph, "page referenced more than once")
+	}
+
+	v.pages[ph] = true
+	p, err := v.a.Get(nil, ph)
+	if err != nil {
+		return
+	}
+
+	if len(p) == 0 {
+		return 0, 0, v.report(ph, "empty page")
+	}
+
+	switch p[0] {
+	case tagBTreeDataPage, tagBTreePrefixDataPage:
+		return v.dataPage(ph, btreeDataPage(p), d)
+	case tagBTreeIndexPage, tagBTreeCountedIndexPage:
+		return v.indexPage(ph, btreeIndexPage(p), d)
+	default:
+		return 0, 0, v.report(ph, "invalid page tag %d", p[0])
+	}
+}
+
+func (v *btreeVerifier) indexPage(ph int64, p btreeIndexPage, d int) (first, n int64, err error) {
+	if w := p.w(); len(p) < 1+w || (len(p)-1-w)%(w+7) != 0 {
+		return 0, 0, v.report(ph, "invalid index page size %d", len(p))
+	}
+
+	v.st.IndexPages++
+	if v.tag < 0 {
+		v.tag = int(p[0])
+	}
+	if int(p[0]) != v.tag {
+		if err = v.report(ph, "index page tag %d, expected %d", p[0], v.tag); err != nil {
+			return
+		}
+	}
+
+	if m := p.len(); m == 0 || d != 0 && m < kIndex-2 || m > 2*kIndex+2 {
+		if err = v.report(ph, "index page has %d items", m); err != nil {
+			return
+		}
+	}
+
+	for i := 0; i <= p.len(); i++ {
+		h, m, err := v.page(p.child(i), d+1)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch {
+		case i == 0:
+			first = h
+		case h != p.dataPage(i-1):
+			if err = v.report(ph, "item %d: data page %#x, expected %#x", i-1, p.dataPage(i-1), h); err != nil {
+				return 0, 0, err
+			}
+		}
+		if p.counted() && p.count(i) != m {
+			if err = v.report(ph, "child %d: count %d, expected %d", i, p.count(i), m); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		n += m
+	}
+	return
+}
+
+func (v *btreeVerifier) dataPage(ph int64, p btreeDataPage, d int) (first, n int64, err error) {
+	if len(p) < 16 || len(p) < p.hdr() || (len(p)-p.hdr())%(2*kKV) != 0 {
+		return 0, 0, v.report(ph, "invalid data page size %d", len(p))
+	}
+
+	v.st.DataPages++
+	if v.depth < 0 {
+		v.depth = d
+	}
+	if d != v.depth {
+		if err = v.report(ph, "data page at depth %d, expected %d", d, v.depth); err != nil {
+			return
+		}
+	}
+
+	if m := p.len(); m == 0 || d != 0 && m < kData-1 || m > 2*kData {
+		if err = v.report(ph, "data page has %d items", m); err != nil {
+			return
+		}
+	}
+
+	if v.next != ph && v.prev != 0 {
+		if err = v.report(v.prev, "next %#x, expected %#x", v.next, ph); err != nil {
+			return
+		}
+	}
+
+	if p.prev() != v.prev {
+		if err = v.report(ph, "prev %#x, expected %#x", p.prev(), v.prev); err != nil {
+			return
+		}
+	}
+
+	v.prev, v.next = ph, p.next()
+	for i := 0; i < p.len(); i++ {
+		off := p.keyOff(i)
+		key, err := v.content(ph, p, off)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if prefix := p.prefix(); key != nil && len(prefix) != 0 {
+			key = append(append([]byte(nil), prefix...), key...)
+		}
+
+		if key != nil && v.lastKey != nil && v.c(v.lastKey, key) >= 0 {
+			if err = v.report(ph, "item %d: key out of order", i); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if key != nil {
+			v.lastKey = key
+		}
+		value, err := v.content(ph, p, off+kKV)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		v.st.item(p, off, len(key), len(value))
+	}
+
+	m := int64(p.len())
+	v.st.Items += m
+	return ph, m, nil
+}
+
+// content returns the key or value at off in the data page ph or nil if its
+// overflow is invalid.
+func (v *btreeVerifier) content(ph int64, p btreeDataPage, off int) (b []byte, err error) {
+	n := int(p[off])
+	if n < kKV {
+		return p.content(v.a, off)
+	}
+
+	if n != 0xff {
+		return nil, v.report(ph, "offset %d: invalid content length %d", off, n)
+	}
+
+	h := b2h(p[off+kH:])
+	if h == 0 {
+		return nil, v.report(ph, "offset %d: nil content handle", off)
+	}
+
+	if v.pages[h] {
+		return nil, v.report(ph, "offset %d: content handle %#x referenced more than once", off, h)
+	}
+
+	v.pages[h] = true
+	if b, err = p.content(v.a, off); err != nil {
+		return
+	}
+
+	if len(b) < kKV {
+		return nil, v.report(ph, "offset %d: content handle %#x, content length %d", off, h, len(b))
+	}
+
+	return
+}
@@ -6,9 +6,11 @@ package lldb
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -19,6 +21,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cznic/fileutil"
@@ -438,6 +441,48 @@ func BenchmarkBTreeGet32(b *testing.B) {
 	benchmarkBTreeGet(b, v)
 }
 
+func benchmarkBTreeView(b *testing.B, v []byte) {
+	b.StopTimer()
+	rng := rand.New(rand.NewSource(42))
+	ka := make([][7]byte, b.N)
+	for _, v := range ka {
+		h2b(v[:], int64(rng.Int63()))
+	}
+	tree := NewBTree(nil)
+	for _, k := range ka {
+		if err := tree.Set(k[:], v); err != nil {
+			b.Fatal(err)
+		}
+	}
+	f := func([]byte) error { return nil }
+	runtime.GC()
+	b.ReportAllocs()
+	b.StartTimer()
+	for _, k := range ka {
+		tree.View(k[:], f)
+	}
+}
+
+func BenchmarkBTreeView1(b *testing.B) {
+	v := make([]byte, 1)
+	benchmarkBTreeView(b, v)
+}
+
+func BenchmarkBTreeView8(b *testing.B) {
+	v := make([]byte, 8)
+	benchmarkBTreeView(b, v)
+}
+
+func BenchmarkBTreeView16(b *testing.B) {
+	v := make([]byte, 16)
+	benchmarkBTreeView(b, v)
+}
+
+func BenchmarkBTreeView32(b *testing.B) {
+	v := make([]byte, 32)
+	benchmarkBTreeView(b, v)
+}
+
 func TestbTreeSeek(t *testing.T) {
 	N := int64(*testN)
 
@@ -1525,6 +1570,122 @@ func TestBTreeEnumeratorInvalidating(t *testing.T) {
 		return err
 	})
 	testbTreeEnumeratorInvalidating(t, func(b *BTree) error { return b.Set([]byte{4}, []byte{5}) })
+	testbTreeEnumeratorInvalidating(t, func(b *BTree) error { return b.DeleteRange([]byte{1}, []byte{2}) })
+}
+
+func TestBTreeEnumeratorMutate(t *testing.T) {
+	const N = 3*kData + 1
+
+	tree := func() *BTree {
+		bt := NewBTree(nil)
+		for i := 0; i < N; i++ {
+			if err := bt.Set(n2b(2*i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return bt
+	}
+
+	// enumerate calls f for the keys returned by Next or, if !forward, Prev
+	// and it checks the keys are returned in the collation order.
+	enumerate := func(bt *BTree, forward bool, f func(k int)) (keys []int) {
+		var en *BTreeEnumerator
+		var err error
+		switch {
+		case forward:
+			en, err = bt.SeekFirst()
+		default:
+			en, err = bt.SeekLast()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			var k []byte
+			switch {
+			case forward:
+				k, _, err = en.Next()
+			default:
+				k, _, err = en.Prev()
+			}
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n := b2n(k)
+			if m := len(keys); m != 0 && (forward && n <= keys[m-1] || !forward && n >= keys[m-1]) {
+				t.Fatal(forward, n, keys[m-1])
+			}
+
+			keys = append(keys, n)
+			f(n)
+		}
+	}
+
+	for _, forward := range []bool{true, false} {
+		// Delete the returned keys.
+		bt := tree()
+		if g, e := len(enumerate(bt, forward, func(k int) {
+			if err := bt.Delete(n2b(k)); err != nil {
+				t.Fatal(err)
+			}
+		})), N; g != e {
+			t.Fatal(forward, g, e)
+		}
+
+		if n, err := bt.Len(); n != 0 || err != nil {
+			t.Fatal(forward, n, err)
+		}
+
+		// Update the returned keys.
+		bt = tree()
+		if g, e := len(enumerate(bt, forward, func(k int) {
+			if err := bt.Set(n2b(k), n2b(k)); err != nil {
+				t.Fatal(err)
+			}
+		})), N; g != e {
+			t.Fatal(forward, g, e)
+		}
+
+		// Delete the key to be returned next and insert the key to
+		// follow it.
+		d := 2
+		if !forward {
+			d = -2
+		}
+		bt = tree()
+		keys := enumerate(bt, forward, func(k int) {
+			if k%8 != 0 {
+				return
+			}
+
+			if err := bt.Delete(n2b(k + d)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := bt.Set(n2b(k+2*d), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := bt.Set(n2b(k+d/2), nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+		for i, k := range keys {
+			if k%8 == 0 && i+1 < len(keys) && keys[i+1] != k+d/2 {
+				t.Fatal(forward, k, keys[i+1])
+			}
+
+			if k%8 == 2 && forward || k%8 == 6 && !forward {
+				t.Fatal(forward, k)
+			}
+		}
+	}
 }
 
 func n2b(n int) []byte {
@@ -1947,3 +2108,1239 @@ func TestKVBug27(t *testing.T) { // https://github.com/cznic/kv/issues/27
 	testKVBug27(t, keys[:796])
 	testKVBug27(t, keys[:797])
 }
+
+func TestBTreeConcurrentGet(t *testing.T) {
+	const (
+		N       = 1000 // Stable keys.
+		readers = 8
+		rounds  = 2000
+	)
+
+	a, err := NewAllocator(NewMemFiler(), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, _, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%08d", i)) }
+	val := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, i%(2*kKV)) }
+	for i := 0; i < N; i++ {
+		if err = bt.Set(key(2*i), val(2*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			rng := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				i := 2 * rng.Intn(N)
+				v, err := bt.Get(nil, key(i))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(v, val(i)) {
+					errs <- fmt.Errorf("Get %d: data mismatch", i)
+					return
+				}
+
+				en, _, err := bt.Seek(key(i))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				var prev []byte
+				for j := 0; j < 10; j++ {
+					k, _, err := en.Next()
+					if err != nil {
+						if err != io.EOF {
+							errs <- err
+						}
+						break
+					}
+
+					if bytes.Compare(k, prev) <= 0 {
+						errs <- fmt.Errorf("Seek %d: keys out of order: %q, %q", i, prev, k)
+						return
+					}
+
+					prev = k
+				}
+			}
+		}(int64(i))
+	}
+
+	// The writer sets and deletes the odd keys.
+	rng := rand.New(rand.NewSource(42))
+	for i := 0; i < rounds; i++ {
+		k := 2*rng.Intn(N) + 1
+		switch rng.Intn(2) {
+		case 0:
+			err = bt.Set(key(k), val(k))
+		default:
+			err = bt.Delete(key(k))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// verifyBTreeShape checks that all data pages are at the same depth, that the
+// pages other than the root do not underflow and that the index pages refer to
+// the leftmost data pages of their children.
+func verifyBTreeShape(a btreeStore, tree btree) error {
+	r, err := a.Get(nil, int64(tree))
+	if err != nil {
+		return err
+	}
+
+	depth := -1
+	var tag byte
+	var f func(ph int64, d int) (int64, int64, error)
+	f = func(ph int64, d int) (first, n int64, err error) {
+		p, err := a.Get(nil, ph)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if !btreePage(p).isIndex() {
+			if depth < 0 {
+				depth = d
+			}
+			if d != depth {
+				return 0, 0, fmt.Errorf("data page %#x at depth %d, expected %d", ph, d, depth)
+			}
+
+			if n := btreePage(p).len(); n == 0 || d != 0 && n < kData {
+				return 0, 0, fmt.Errorf("data page %#x underflow: %d", ph, n)
+			}
+
+			return ph, int64(btreePage(p).len()), nil
+		}
+
+		ip := btreeIndexPage(p)
+		if n := ip.len(); n == 0 || d != 0 && n < kIndex-2 {
+			return 0, 0, fmt.Errorf("index page %#x underflow: %d", ph, n)
+		}
+
+		if d == 0 {
+			tag = p[0]
+		}
+		if p[0] != tag {
+			return 0, 0, fmt.Errorf("index page %#x: tag %d, expected %d", ph, p[0], tag)
+		}
+
+		for i := 0; i <= ip.len(); i++ {
+			h, m, err := f(ip.child(i), d+1)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			switch {
+			case i == 0:
+				first = h
+			case h != ip.dataPage(i-1):
+				return 0, 0, fmt.Errorf("index page %#x: dataPage[%d] %#x, expected %#x", ph, i-1, ip.dataPage(i-1), h)
+			}
+			if ip.counted() && ip.count(i) != m {
+				return 0, 0, fmt.Errorf("index page %#x: count[%d] %d, expected %d", ph, i, ip.count(i), m)
+			}
+
+			n += m
+		}
+		return
+	}
+
+	if ph := b2h(r); ph != 0 {
+		_, _, err = f(ph, 0)
+	}
+	return err
+}
+
+func TestBTreeDeleteRange(t *testing.T) {
+	const N = 20000
+
+	key := func(i int) []byte {
+		k := n2b(i)
+		if i%7 == 0 {
+			k = append(k, make([]byte, kKV)...)
+		}
+		return k
+	}
+	val := func(i int) []byte { return make([]byte, i%(2*kKV)) }
+
+	test := func(bt *BTree, check func()) {
+		var keys []int // Reference.
+		for i := 0; i < N; i++ {
+			if err := bt.Set(key(2*i), val(2*i)); err != nil {
+				t.Fatal(err)
+			}
+
+			keys = append(keys, 2*i)
+		}
+
+		rng := rand.New(rand.NewSource(42))
+		for round := 0; len(keys) != 0; round++ {
+			lo, hi := -1, 2*N
+			var from, to []byte
+			switch x := rng.Intn(8); {
+			case round == 40:
+				// nop, delete everything
+			case x == 0:
+				hi = rng.Intn(N / 8)
+				to = key(hi)
+			case x == 1:
+				lo = 2*N - rng.Intn(N/8)
+				from = key(lo)
+			default:
+				lo = rng.Intn(2 * N)
+				hi = lo + rng.Intn(1+N>>uint(rng.Intn(16)))
+				from, to = key(lo), key(hi)
+			}
+			if err := bt.DeleteRange(from, to); err != nil {
+				t.Fatal(err)
+			}
+
+			var rest []int
+			for _, k := range keys {
+				if k < lo || k >= hi {
+					rest = append(rest, k)
+				}
+			}
+			keys = rest
+
+			if err := verifyPageLinks(bt.store, bt.root, len(keys)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := verifyBTreeShape(bt.store, bt.root); err != nil {
+				t.Fatal(err)
+			}
+
+			en, err := bt.SeekFirst()
+			if err != nil && len(keys) != 0 {
+				t.Fatal(err)
+			}
+
+			for _, k := range keys {
+				gk, gv, err := en.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(gk, key(k)) || !bytes.Equal(gv, val(k)) {
+					t.Fatalf("got key %x, expected %x", gk, key(k))
+				}
+			}
+		}
+		check()
+	}
+
+	bt := NewBTree(nil)
+	test(bt, func() {
+		if g, e := len(bt.store.(*memBTreeStore).m), 1; g != e {
+			t.Fatal(g, e)
+		}
+	})
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bt, _, err = CreateBTree(store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test(bt, func() {
+		if sz, _ := f.Size(); sz != sz0 {
+			t.Fatal(sz, sz0)
+		}
+	})
+}
+
+func TestCreateBTreeFromSorted(t *testing.T) {
+	key := func(i int) []byte {
+		k := n2b(i)
+		if i%7 == 0 {
+			k = append(k, make([]byte, kKV)...)
+		}
+		return k
+	}
+	val := func(i int) []byte { return make([]byte, i%(2*kKV)) }
+	source := func(n int) func() ([]byte, []byte, error) {
+		i := 0
+		return func() (k, v []byte, err error) {
+			if i == n {
+				return nil, nil, io.EOF
+			}
+
+			k, v = key(2*i), val(2*i)
+			i++
+			return
+		}
+	}
+
+	check := func(bt *BTree, n int) {
+		if err := verifyPageLinks(bt.store, bt.root, n); err != nil {
+			t.Fatal(n, err)
+		}
+
+		if err := verifyBTreeShape(bt.store, bt.root); err != nil {
+			t.Fatal(n, err)
+		}
+
+		for i := 0; i < n; i += 1 + n/1000 {
+			v, err := bt.Get(nil, key(2*i))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(v, val(2*i)) {
+				t.Fatal(n, i)
+			}
+		}
+
+		// The tree is usable as any other.
+		for i := 0; i < n && i < 3*kData; i++ {
+			if err := bt.Set(key(2*i+1), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := bt.Delete(key(2 * i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := verifyPageLinks(bt.store, bt.root, n); err != nil {
+			t.Fatal(n, err)
+		}
+	}
+
+	for _, n := range []int{0, 1, kData, 2 * kData, 2*kData + 1, 5*kData + 7, (2*kIndex+1)*2*kData + 1} {
+		bt, err := NewBTreeFromSorted(nil, source(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(bt, n)
+		if n > 5*kData+7 {
+			continue
+		}
+
+		a, err := NewAllocator(NewMemFiler(), &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bt, _, err = CreateBTreeFromSorted(a, nil, source(n)); err != nil {
+			t.Fatal(err)
+		}
+
+		check(bt, n)
+	}
+
+	// Failures remove the tree.
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := source(3 * kData)
+	i := 0
+	_, _, err = CreateBTreeFromSorted(a, nil, func() ([]byte, []byte, error) {
+		if i++; i == 2*kData+2 {
+			return key(0), nil, nil
+		}
+
+		return next()
+	})
+	if _, ok := err.(*ErrINVAL); !ok {
+		t.Fatalf("%T %v", err, err)
+	}
+
+	next, i = source(3*kData), 0
+	if _, _, err = CreateBTreeFromSorted(a, nil, func() ([]byte, []byte, error) {
+		if i++; i == 2*kData+2 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
+		return next()
+	}); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+
+	if sz, _ := f.Size(); sz != sz0 {
+		t.Fatal(sz, sz0)
+	}
+}
+
+// uncountBTree rewrites the index pages of the subtree ph in the format
+// without counts.
+func uncountBTree(a btreeStore, ph int64) error {
+	p, err := a.Get(nil, ph)
+	if err != nil || !btreePage(p).isIndex() {
+		return err
+	}
+
+	ip := btreeIndexPage(p)
+	q := newBTreeIndexPage(tagBTreeIndexPage, 0).setLen(ip.len())
+	for i := 0; i <= ip.len(); i++ {
+		if err = uncountBTree(a, ip.child(i)); err != nil {
+			return err
+		}
+
+		q.setChild(i, ip.child(i))
+		if i < ip.len() {
+			q.setDataPage(i, ip.dataPage(i))
+		}
+	}
+	return a.Realloc(ph, q)
+}
+
+func TestBTreeRank(t *testing.T) {
+	const N = 5000
+
+	key := func(i int) []byte { return n2b(2*i + 1) } // Even keys are never present.
+
+	test := func(bt *BTree) {
+		rng := rand.New(rand.NewSource(42))
+		counted := func() bool {
+			r, err := bt.store.Get(nil, int64(bt.root))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := bt.store.Get(nil, b2h(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return !btreePage(p).isIndex() || btreeIndexPage(p).counted()
+		}
+
+		check := func() {
+			if err := verifyBTreeShape(bt.store, bt.root); err != nil {
+				t.Fatal(err)
+			}
+
+			var keys []int
+			en, err := bt.SeekFirst()
+			for err == nil {
+				var k []byte
+				if k, _, err = en.Next(); err == nil {
+					keys = append(keys, b2n(k))
+				}
+			}
+
+			n, err := bt.Len()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := n, int64(len(keys)); g != e {
+				t.Fatal(g, e)
+			}
+
+			for i := 0; i < len(keys); i += 1 + rng.Intn(16) {
+				k, _, err := bt.Nth(int64(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if g, e := b2n(k), keys[i]; g != e {
+					t.Fatal(i, g, e)
+				}
+
+				for _, k := range []int{keys[i], keys[i] - 1} {
+					r, err := bt.Rank(n2b(k))
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if g, e := r, int64(i); g != e {
+						t.Fatal(k, g, e)
+					}
+				}
+			}
+
+			for _, i := range []int64{-1, n} {
+				if _, _, err := bt.Nth(i); err == nil {
+					t.Fatal(i)
+				} else if _, ok := err.(*ErrINVAL); !ok {
+					t.Fatalf("%T %v", err, err)
+				}
+			}
+
+			for j := 0; j < 50; j++ {
+				lo, hi := rng.Intn(2*N+2), rng.Intn(2*N+2)
+				from, to := n2b(lo), n2b(hi)
+				switch j {
+				case 0:
+					from, lo = nil, 0
+				case 1:
+					to, hi = nil, 2*N+2
+				case 2:
+					from, lo, to, hi = nil, 0, nil, 2*N+2
+				}
+				g, err := bt.Count(from, to)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var e int64
+				if lo < hi {
+					e = int64(sort.SearchInts(keys, hi) - sort.SearchInts(keys, lo))
+				}
+				if g != e {
+					t.Fatal(lo, hi, g, e)
+				}
+			}
+		}
+
+		for round := 0; round < 6; round++ {
+			for i := 0; i < N; i++ {
+				k := key(rng.Intn(N))
+				switch rng.Intn(5) {
+				case 0:
+					if err := bt.Delete(k); err != nil {
+						t.Fatal(err)
+					}
+				case 1:
+					if _, err := bt.DeleteAny(); err != nil {
+						t.Fatal(err)
+					}
+				default:
+					if err := bt.Set(k, k); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			check()
+			if round == 2 { // Trees created before the counts were introduced.
+				r, err := bt.store.Get(nil, int64(bt.root))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err = uncountBTree(bt.store, b2h(r)); err != nil {
+					t.Fatal(err)
+				}
+
+				if counted() {
+					t.Fatal("tree is counted")
+				}
+
+				check()
+			}
+			if g, e := counted(), round < 2; g != e {
+				t.Fatal(round, g, e)
+			}
+		}
+
+		// An uncounted tree is counted again after shrinking to a single data
+		// page.
+		if err := bt.Clear(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3*kData; i++ {
+			if err := bt.Set(key(i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !counted() {
+			t.Fatal("tree is not counted")
+		}
+
+		check()
+	}
+
+	test(NewBTree(nil))
+
+	a, err := NewAllocator(NewMemFiler(), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, _, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test(bt)
+}
+
+func TestBTreeVerify(t *testing.T) {
+	const N = 5 * kData
+
+	bt := NewBTree(nil)
+	for i := 0; i < N; i++ {
+		k := n2b(i)
+		if i%100 == 0 {
+			k = append(k, make([]byte, kKV)...) // Overflowed key.
+		}
+		if err := bt.Set(k, n2b(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := bt.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Depth != 2 || st.IndexPages != 1 || st.DataPages != 3 || st.Items != N {
+		t.Fatalf("%+v", st)
+	}
+
+	s := bt.store.(*memBTreeStore)
+	r, err := s.Get(nil, int64(bt.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iroot := b2h(r)
+	ph := btreeIndexPage(s.m[iroot]).child(2)
+
+	var logged []error
+	log := func(err error) bool {
+		logged = append(logged, err)
+		return true
+	}
+
+	corrupt := func(f func(p []byte) []byte) {
+		p := s.m[ph]
+		defer func() { s.m[ph] = p }()
+
+		s.m[ph] = f(append([]byte(nil), p...))
+		logged = nil
+		if _, err := bt.Verify(log); err == nil || len(logged) == 0 {
+			t.Fatal(err, logged)
+		}
+
+		for _, err := range logged {
+			if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrBTree {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Swap the first two keys.
+	corrupt(func(p []byte) []byte {
+		a := append([]byte(nil), p[15:15+kKV]...)
+		copy(p[15:], p[15+2*kKV:15+3*kKV])
+		copy(p[15+2*kKV:], a)
+		return p
+	})
+	// Break the prev link.
+	corrupt(func(p []byte) []byte { btreeDataPage(p).setPrev(ph); return p })
+	// Break the next link.
+	corrupt(func(p []byte) []byte { btreeDataPage(p).setNext(ph); return p })
+	// Underflow.
+	corrupt(func(p []byte) []byte { return btreeDataPage(p).setLen(1) })
+	// Invalid tag.
+	corrupt(func(p []byte) []byte { p[0] = 42; return p })
+
+	if _, err := bt.Verify(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid count.
+	ph = iroot
+	corrupt(func(p []byte) []byte {
+		ip := btreeIndexPage(p)
+		ip.setCount(1, ip.count(1)+1)
+		return p
+	})
+}
+
+func TestBTreeStats(t *testing.T) {
+	const N = 10 * kData
+
+	test := func(bt *BTree) {
+		st, err := bt.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := st, (BTreeStats{}); g != e {
+			t.Fatalf("%+v", g)
+		}
+
+		var e BTreeStats
+		for i := 0; i < N; i++ {
+			k, v := n2b(i), n2b(i)
+			if i%10 == 0 {
+				k = append(k, make([]byte, kKV)...) // Overflowed key.
+				e.OverflowKeys++
+			}
+			if i%7 == 0 {
+				v = make([]byte, 2*kKV+i) // Overflowed value.
+				e.OverflowValues++
+			}
+			if err := bt.Set(k, v); err != nil {
+				t.Fatal(err)
+			}
+
+			e.KeyBytes += int64(len(k))
+			e.ValueBytes += int64(len(v))
+		}
+
+		if st, err = bt.Stats(); err != nil {
+			t.Fatal(err)
+		}
+
+		vst, err := bt.Verify(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st != vst {
+			t.Fatalf("%+v %+v", st, vst)
+		}
+
+		// The shape depends on the splits, see TestBTreeStatsShape.
+		e.Depth, e.IndexPages, e.DataPages, e.Items = st.Depth, st.IndexPages, st.DataPages, N
+		e.IndexFill, e.DataFill = st.IndexFill, st.DataFill
+		if st != e {
+			t.Fatalf("%+v %+v", st, e)
+		}
+	}
+
+	test(NewBTree(nil))
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, _, err := CreateBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test(bt)
+}
+
+func TestBTreeStatsShape(t *testing.T) {
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := func(n int) func() ([]byte, []byte, error) {
+		i := 0
+		return func() ([]byte, []byte, error) {
+			if i == n {
+				return nil, nil, io.EOF
+			}
+
+			i++
+			return n2b(i), nil, nil
+		}
+	}
+
+	check := func(bt *BTree, e BTreeStats) {
+		st, err := bt.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st != e {
+			t.Fatalf("\ngot %+v\nexp %+v", st, e)
+		}
+	}
+
+	// A single full data page, filled by Set.
+	bt, _, err := CreateBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2*kData; i++ {
+		if err = bt.Set(n2b(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(bt, BTreeStats{Depth: 1, DataPages: 1, Items: 2 * kData, DataFill: 1, KeyBytes: 8 * 2 * kData})
+
+	// The next item splits the page in halves below a new root index page
+	// with one item.
+	if err = bt.Set(n2b(2*kData), nil); err != nil {
+		t.Fatal(err)
+	}
+	check(bt, BTreeStats{
+		Depth:      2,
+		IndexPages: 1,
+		DataPages:  2,
+		Items:      2*kData + 1,
+		IndexFill:  1. / (2 * kIndex),
+		DataFill:   float64(2*kData+1) / (2 * 2 * kData),
+		KeyBytes:   8 * (2*kData + 1),
+	})
+
+	// Bulk loading fills the data pages, ten of them are referred to by ten
+	// items of the root index page.
+	if bt, _, err = CreateBTreeFromSorted(store, nil, source(10*2*kData)); err != nil {
+		t.Fatal(err)
+	}
+	check(bt, BTreeStats{
+		Depth:      2,
+		IndexPages: 1,
+		DataPages:  10,
+		Items:      10 * 2 * kData,
+		IndexFill:  9. / (2 * kIndex),
+		DataFill:   1,
+		KeyBytes:   8 * 10 * 2 * kData,
+	})
+
+	// 2*kIndex+1 full data pages and one half full: The 2*kIndex+2 data
+	// pages are split to two index pages, kIndex+1 children each, below a
+	// root index page with a single item.
+	n := (2*kIndex+1)*2*kData + kData
+	if bt, _, err = CreateBTreeFromSorted(store, nil, source(n)); err != nil {
+		t.Fatal(err)
+	}
+	check(bt, BTreeStats{
+		Depth:      3,
+		IndexPages: 3,
+		DataPages:  2*kIndex + 2,
+		Items:      int64(n),
+		IndexFill:  float64(2*kIndex+1) / (3 * 2 * kIndex),
+		DataFill:   float64(n) / float64((2*kIndex+2)*2*kData),
+		KeyBytes:   8 * int64(n),
+	})
+}
+
+func TestBTreePrefixCompression(t *testing.T) {
+	const N = 2000
+
+	// Shortlex collation, the keys between two keys of a page need not
+	// have their common prefix.
+	shortlex := func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+
+		return bytes.Compare(a, b)
+	}
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("array/record/field/%c%d", 'a'+i%3, i))
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	fill := func(bt *BTree, m map[int]bool, n int) {
+		for _, i := range rng.Perm(N)[:n] {
+			if m[i] && i%2 == 0 {
+				if err := bt.Delete(key(i)); err != nil {
+					t.Fatal(err)
+				}
+
+				delete(m, i)
+				continue
+			}
+
+			if err := bt.Set(key(i), n2b(i)); err != nil {
+				t.Fatal(err)
+			}
+
+			m[i] = true
+		}
+	}
+
+	check := func(bt *BTree, m map[int]bool) BTreeStats {
+		st, err := bt.Verify(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := st.Items, int64(len(m)); g != e {
+			t.Fatal(g, e)
+		}
+
+		for i := range m {
+			v, err := bt.Get(nil, key(i))
+			if err != nil || v == nil || b2n(v) != i {
+				t.Fatal(i, v, err)
+			}
+		}
+		return st
+	}
+
+	sizes := map[bool]int64{}
+	for _, on := range []bool{false, true} {
+		f := NewMemFiler()
+		a, err := NewAllocator(f, &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bt, h, err := CreateBTree(a, shortlex)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = bt.SetPrefixCompression(on); err != nil {
+			t.Fatal(err)
+		}
+
+		m := map[int]bool{}
+		fill(bt, m, N)
+		st := check(bt, m)
+		switch {
+		case on:
+			if st.OverflowKeys != 0 {
+				t.Fatalf("%+v", st)
+			}
+		default:
+			if st.OverflowKeys != st.Items {
+				t.Fatalf("%+v", st)
+			}
+		}
+
+		if sizes[on], err = f.Size(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Switch the format of a populated tree and back.
+		for _, on := range []bool{!on, on} {
+			if err = bt.SetPrefixCompression(on); err != nil {
+				t.Fatal(err)
+			}
+
+			fill(bt, m, N/2)
+			check(bt, m)
+		}
+
+		if bt, err = OpenBTree(a, shortlex, h); err != nil {
+			t.Fatal(err)
+		}
+
+		check(bt, m)
+		if err = RemoveBTree(a, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if g, e := sizes[true], sizes[false]; g >= e/2 {
+		t.Fatal(g, e)
+	}
+}
+
+func TestBTreeView(t *testing.T) {
+	const N = 3 * kData
+
+	key := func(i int) []byte {
+		if i%4 == 0 { // Overflows unless the prefix is compressed.
+			return []byte(fmt.Sprintf("view/%s/%05d", strings.Repeat("k", kKV), i))
+		}
+
+		return []byte(fmt.Sprintf("view/%05d", i))
+	}
+
+	value := func(i int) []byte {
+		if i%3 == 0 { // Overflows.
+			return bytes.Repeat(n2b(i), 2*kKV)
+		}
+
+		return n2b(i)
+	}
+
+	errView := errors.New("view")
+	for _, on := range []bool{false, true} {
+		a, err := NewAllocator(NewMemFiler(), &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bt, _, err := CreateBTree(a, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = bt.SetPrefixCompression(on); err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for i := 0; i < N; i++ {
+			k := key(i)
+			if err = bt.Set(k, value(i)); err != nil {
+				t.Fatal(err)
+			}
+
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+
+		for i := 0; i < N; i++ {
+			var g []byte
+			ok, err := bt.View(key(i), func(v []byte) error {
+				g = append([]byte(nil), v...)
+				return nil
+			})
+			if !ok || err != nil || !bytes.Equal(g, value(i)) {
+				t.Fatal(on, i, ok, err, g)
+			}
+		}
+
+		if ok, err := bt.View([]byte("missing"), func([]byte) error {
+			t.Fatal("f called for a missing key")
+			return nil
+		}); ok || err != nil {
+			t.Fatal(on, ok, err)
+		}
+
+		if ok, err := bt.View(key(1), func([]byte) error { return errView }); !ok || err != errView {
+			t.Fatal(on, ok, err)
+		}
+
+		// Enumerate forward deleting every other key in f and back.
+		en, err := bt.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rest []string
+		for i := 0; ; i++ {
+			if err = en.NextView(func(k, v []byte) error {
+				if string(k) != keys[i] {
+					t.Fatalf("%v %d %q %q", on, i, k, keys[i])
+				}
+
+				if g, err := bt.Get(nil, k); err != nil || !bytes.Equal(v, g) {
+					t.Fatal(on, i, err)
+				}
+
+				if i%2 == 0 {
+					return bt.Delete(k)
+				}
+
+				rest = append(rest, string(k))
+				return nil
+			}); err != nil {
+				if err != io.EOF || i != N {
+					t.Fatal(on, i, err)
+				}
+
+				break
+			}
+		}
+
+		if en, err = bt.SeekLast(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := len(rest) - 1; ; i-- {
+			if err = en.PrevView(func(k, v []byte) error {
+				if string(k) != rest[i] {
+					t.Fatalf("%v %d %q %q", on, i, k, rest[i])
+				}
+
+				return errView
+			}); err != nil && err != errView {
+				if err != io.EOF || i != -1 {
+					t.Fatal(on, i, err)
+				}
+
+				break
+			}
+		}
+	}
+}
+
+func TestBTreeRehandle(t *testing.T) {
+	testBTreeRehandle(t, &Options{})
+	testBTreeRehandle(t, &Options{Generations: true})
+}
+
+func testBTreeRehandle(t *testing.T, opts *Options) {
+	const N = 3000
+
+	f := NewMemFiler()
+	a, err := NewAllocator(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Freed later, so the roots of the trees are moved too.
+	filler, err := a.Alloc(make([]byte, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var trees []*BTree
+	var refs []map[string][]byte
+	for i := 0; i < 3; i++ {
+		bt, h, err := CreateBTree(a, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := h>>genShift != 0, opts.Generations; g != e {
+			t.Fatal(g, e)
+		}
+
+		if i == 1 {
+			if err = bt.SetPrefixCompression(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		trees = append(trees, bt)
+		refs = append(refs, map[string][]byte{})
+	}
+
+	for i := 0; i < N; i++ {
+		j := rng.Intn(len(trees))
+		k := []byte(fmt.Sprintf("key prefix %08d", rng.Int()))
+		if i%3 == 0 {
+			k = append(k, rndBytes(rng, 2*kKV)...)
+		}
+		v := rndBytes(rng, rng.Intn(3*kKV))
+		if err = trees[j].Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+
+		refs[j][string(k)] = v
+	}
+
+	for j, bt := range trees {
+		for k := range refs[j] {
+			if rng.Intn(3) != 0 {
+				if err = bt.Delete([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+
+				delete(refs[j], k)
+			}
+		}
+	}
+
+	if err = a.Free(filler); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k := range refs[0] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	en, _, err := trees[0].Seek([]byte(keys[len(keys)/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, moved, err := a.CompactRehandle(context.Background(), -1, func(int64) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("size %d -> %d, %d blocks moved", sz0, sz0-n, len(moved))
+	if n == 0 || len(moved) == 0 {
+		t.Fatal(n, len(moved))
+	}
+
+	for j, bt := range trees {
+		h := bt.Handle()
+		if _, ok := moved[h&maxHandle]; !ok {
+			t.Fatal(j, h)
+		}
+
+		switch j {
+		case 2:
+			// Not open.
+			if h, err = RehandleBTree(a, h, moved); err != nil {
+				t.Fatal(err)
+			}
+
+			if trees[j], err = OpenBTree(a, nil, h); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			if err = bt.Rehandle(moved); err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := bt.Handle(), moved[h&maxHandle]|h&^maxHandle; g != e {
+				t.Fatal(g, e)
+			}
+		}
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for j, bt := range trees {
+		if _, err = bt.Verify(nil); err != nil {
+			t.Fatal(j, err)
+		}
+
+		if g, err := bt.Len(); err != nil || g != int64(len(refs[j])) {
+			t.Fatal(j, g, len(refs[j]), err)
+		}
+
+		for k, v := range refs[j] {
+			if g, err := bt.Get(nil, []byte(k)); err != nil || !bytes.Equal(g, v) {
+				t.Fatal(j, err)
+			}
+		}
+	}
+
+	// The enumerator continues after the tree was rehandled.
+	for _, k := range keys[len(keys)/2:] {
+		g, _, err := en.Next()
+		if err != nil || string(g) != k {
+			t.Fatalf("%q %q %v", g, k, err)
+		}
+	}
+}
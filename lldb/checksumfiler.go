@@ -0,0 +1,305 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Filer detecting corrupted data using per page checksums.
+
+package lldb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/cznic/bufs"
+	"github.com/cznic/fileutil"
+)
+
+var _ Filer = &ChecksumFiler{} // Ensure ChecksumFiler is a Filer.
+
+const (
+	csBits = 9
+	csSize = 1 << csBits
+	csMask = csSize - 1
+)
+
+var (
+	csTable    = crc32.MakeTable(crc32.Castagnoli)
+	csZeroPage [csSize]byte
+	csZeroSum  = crc32.Checksum(csZeroPage[:], csTable)
+)
+
+// ChecksumFiler is a Filer which maintains a CRC32C (Castagnoli) checksum for
+// every 512 byte page of the wrapped data Filer and verifies the checksums of
+// all pages touched by ReadAt. Any mismatch is reported as an *ErrILSEQ of
+// Type ErrChecksum, the .Off field is the offset of the corrupted page.
+//
+// The checksums are kept in a separate side Filer, 4 bytes in network byte
+// order per page, page N at offset 4*N. A stored value is the page checksum
+// XORed with the checksum of an all zeros page, so pages never written, or
+// holes, need no side Filer updates and verify as zeros.
+//
+// The last, partial page of the data Filer is checksummed as if it was padded
+// with zero bytes to the full page size.
+//
+// ChecksumFiler implements BeginUpdate, EndUpdate and Rollback by invoking
+// them on both the data and checksums Filers. The data and checksums are not
+// updated atomically, so, like for a SimpleFileFiler, structural integrity
+// has to be provided by wrapping a ChecksumFiler in eg. a RollbackFiler or
+// ACIDFiler0.
+type ChecksumFiler struct {
+	f    Filer
+	sums Filer
+}
+
+// NewChecksumFiler returns a new ChecksumFiler wrapping f and storing the
+// checksums in sums. To start checksumming an existing f, sums must be of
+// zero size and f must contain only zero bytes. Otherwise sums must be the
+// Filer used with f before.
+func NewChecksumFiler(f, sums Filer) (r *ChecksumFiler, err error) {
+	if f == nil || sums == nil {
+		return nil, &ErrINVAL{Src: "lldb.NewChecksumFiler, nil argument"}
+	}
+
+	return &ChecksumFiler{f: f, sums: sums}, nil
+}
+
+// BeginUpdate implements Filer.
+func (f *ChecksumFiler) BeginUpdate() (err error) {
+	if err = f.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	if err = f.sums.BeginUpdate(); err != nil {
+		f.f.Rollback()
+	}
+	return
+}
+
+// Close implements Filer.
+func (f *ChecksumFiler) Close() (err error) {
+	err = f.f.Close()
+	if err2 := f.sums.Close(); err == nil {
+		err = err2
+	}
+	return
+}
+
+// EndUpdate implements Filer.
+func (f *ChecksumFiler) EndUpdate() (err error) {
+	err = f.f.EndUpdate()
+	if err2 := f.sums.EndUpdate(); err == nil {
+		err = err2
+	}
+	return
+}
+
+// Name implements Filer.
+func (f *ChecksumFiler) Name() string {
+	return f.f.Name()
+}
+
+// PunchHole implements Filer.
+func (f *ChecksumFiler) PunchHole(off, size int64) (err error) {
+	if err = f.f.PunchHole(off, size); err != nil {
+		return
+	}
+
+	// Nothing is guaranteed about the hole content, resum what is there.
+	return f.update(off, off+size)
+}
+
+// ReadAt implements Filer. Checksums of all pages overlapped by b are
+// verified.
+func (f *ChecksumFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":ReadAt invalid off", off}
+	}
+
+	sz, err := f.f.Size()
+	if err != nil {
+		return
+	}
+
+	avail := sz - off
+	if avail <= 0 {
+		return 0, io.EOF
+	}
+
+	rq := int64(len(b))
+	if rq > avail {
+		rq = avail
+	}
+	first, last := off&^csMask, (off+rq-1)&^csMask+csSize
+	if last > sz {
+		last = sz
+	}
+	buf := bufs.GCache.Get(int(last - first))
+	defer bufs.GCache.Put(buf)
+	if err = f.read(buf, first); err != nil {
+		return
+	}
+
+	if err = f.verify(buf, first); err != nil {
+		return
+	}
+
+	if n = copy(b, buf[off-first:]); n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Rollback implements Filer.
+func (f *ChecksumFiler) Rollback() (err error) {
+	err = f.f.Rollback()
+	if err2 := f.sums.Rollback(); err == nil {
+		err = err2
+	}
+	return
+}
+
+// Size implements Filer.
+func (f *ChecksumFiler) Size() (int64, error) {
+	return f.f.Size()
+}
+
+// Sync implements Filer.
+func (f *ChecksumFiler) Sync() (err error) {
+	if err = f.f.Sync(); err != nil {
+		return
+	}
+
+	return f.sums.Sync()
+}
+
+// Truncate implements Filer.
+func (f *ChecksumFiler) Truncate(size int64) (err error) {
+	if size < 0 {
+		return &ErrINVAL{"Truncate size", size}
+	}
+
+	sz, err := f.f.Size()
+	if err != nil {
+		return
+	}
+
+	if err = f.f.Truncate(size); err != nil {
+		return
+	}
+
+	if err = f.sums.Truncate(4 * ((size + csMask) >> csBits)); err != nil {
+		return
+	}
+
+	switch {
+	case size < sz: // The new last page may have been cut.
+		if size != 0 {
+			return f.update(size-1, size)
+		}
+	case size > sz: // The former last page may have grown.
+		return f.update(sz, sz+1)
+	}
+	return
+}
+
+// WriteAt implements Filer.
+func (f *ChecksumFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":WriteAt invalid off", off}
+	}
+
+	sz, err := f.f.Size()
+	if err != nil {
+		return
+	}
+
+	if n, err = f.f.WriteAt(b, off); err != nil {
+		return
+	}
+
+	from := off
+	if sz < from { // The former last page may have grown.
+		from = sz
+	}
+	if err = f.update(from, off+int64(n)); err != nil {
+		return 0, err
+	}
+
+	return
+}
+
+func (f *ChecksumFiler) read(b []byte, off int64) (err error) {
+	if n, err := f.f.ReadAt(b, off); n != len(b) {
+		return &ErrILSEQ{Type: ErrOther, Off: off, More: err}
+	}
+
+	return nil
+}
+
+// csSum returns the stored form of the checksum of a page with content b.
+func csSum(b []byte) uint32 {
+	s := crc32.Update(0, csTable, b)
+	if n := len(b); n < csSize {
+		s = crc32.Update(s, csTable, csZeroPage[:csSize-n])
+	}
+	return s ^ csZeroSum
+}
+
+// update recomputes the checksums of all pages overlapping [from, to).
+func (f *ChecksumFiler) update(from, to int64) (err error) {
+	sz, err := f.f.Size()
+	if err != nil {
+		return
+	}
+
+	if to > sz {
+		to = sz
+	}
+	if from >= to {
+		return
+	}
+
+	first, pages := from>>csBits, int((to-1)>>csBits-from>>csBits)+1
+	sums := bufs.GCache.Get(4 * pages)
+	defer bufs.GCache.Put(sums)
+	pg := bufs.GCache.Get(csSize)
+	defer bufs.GCache.Put(pg)
+	for i := 0; i < pages; i++ {
+		off := (first + int64(i)) << csBits
+		rq := csSize
+		if off+csSize > sz {
+			rq = int(sz - off)
+		}
+		if err = f.read(pg[:rq], off); err != nil {
+			return
+		}
+
+		binary.BigEndian.PutUint32(sums[4*i:], csSum(pg[:rq]))
+	}
+	_, err = f.sums.WriteAt(sums, 4*first)
+	return
+}
+
+// verify checks the checksums of the pages in b, which must start at a page
+// boundary off.
+func (f *ChecksumFiler) verify(b []byte, off int64) (err error) {
+	pages := (len(b) + csMask) >> csBits
+	sums := bufs.GCache.Cget(4 * pages)
+	defer bufs.GCache.Put(sums)
+	if _, err = f.sums.ReadAt(sums, 4*(off>>csBits)); err != nil && !fileutil.IsEOF(err) {
+		return
+	}
+
+	err = nil
+	for i := 0; i < pages; i++ {
+		pg := b[i<<csBits:]
+		if len(pg) > csSize {
+			pg = pg[:csSize]
+		}
+		if binary.BigEndian.Uint32(sums[4*i:]) != csSum(pg) {
+			return &ErrILSEQ{Type: ErrChecksum, Off: off + int64(i)<<csBits, Name: f.Name()}
+		}
+	}
+	return
+}
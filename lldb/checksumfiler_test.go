@@ -0,0 +1,165 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+var newChecksumFiler = func() Filer {
+	f, err := NewChecksumFiler(NewMemFiler(), NewMemFiler())
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+func TestChecksumFiler(t *testing.T) {
+	testFilerNesting(t, newChecksumFiler)
+	testFilerTruncate(t, newChecksumFiler)
+	testFilerReadAtWriteAt(t, newChecksumFiler)
+	testInnerFiler(t, newChecksumFiler)
+	testFileReadAtHole(t, newChecksumFiler)
+}
+
+func TestChecksumFilerCorruption(t *testing.T) {
+	data := NewMemFiler()
+	f, err := NewChecksumFiler(data, NewMemFiler())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 3*csSize+100)
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	if _, err = f.WriteAt(b, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Truncate(int64(len(b)) + 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, len(b))
+	if _, err = f.ReadAt(g, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(g, b) {
+		t.Fatal("data mismatch")
+	}
+
+	// Flip a bit of the 3rd page.
+	off := int64(2*csSize + 17)
+	if _, err = data.ReadAt(g[:1], off); err != nil {
+		t.Fatal(err)
+	}
+
+	g[0] ^= 0x10
+	if _, err = data.WriteAt(g[:1], off); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads not touching the damaged page still work.
+	if _, err = f.ReadAt(g[:csSize], csSize); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.ReadAt(g[:10], off-5)
+	e, ok := err.(*ErrILSEQ)
+	if !ok || e.Type != ErrChecksum {
+		t.Fatalf("%T(%v)", err, err)
+	}
+
+	if g, e := e.Off, int64(2*csSize); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestChecksumFilerAllocator(t *testing.T) {
+	const N = 1 << 11
+
+	data, sums := NewMemFiler(), NewMemFiler()
+	cf, err := NewChecksumFiler(data, sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewRollbackFiler(cf, func(sz int64) error { return cf.Truncate(sz) }, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Compress = true
+	tr, h, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var k [8]byte
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(rng.Int63()))
+		if err = tr.Set(k[:], rndBytes(rng, rng.Intn(1000))); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%3 == 0 {
+			if _, err = tr.DeleteAny(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen using a fresh ChecksumFiler on the same data/sums.
+	if cf, err = NewChecksumFiler(data, sums); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewAllocator(cf, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr, err = OpenBTree(a, nil, h); err != nil {
+		t.Fatal(err)
+	}
+
+	enum, err := tr.SeekFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, _, err = enum.Next(); err != nil {
+			break
+		}
+	}
+	if _, ok := err.(*ErrILSEQ); ok {
+		t.Fatal(err)
+	}
+}
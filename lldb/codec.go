@@ -0,0 +1,91 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Block content compression codecs.
+
+package lldb
+
+import (
+	"sync"
+
+	"github.com/cznic/zappy"
+)
+
+const (
+	minCodecCC = 2    // First CC value available to RegisterCodec.
+	maxCodecCC = 0xfd // Last CC value available to RegisterCodec.
+)
+
+// Codec compresses the content of used blocks. The CC tail tag of a block
+// selects the Codec used to decode its content. See RegisterCodec and the
+// 'Content compression' subtitle in the Allocator documentation.
+//
+// The methods of a Codec must be safe for concurrent use by multiple
+// goroutines.
+type Codec interface {
+	// Encode returns the encoded form of src. The returned slice may be a
+	// sub-slice of dst if dst was large enough to hold the entire encoded
+	// form. Otherwise, a newly allocated slice will be returned.
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode returns the decoded form of src. The returned slice may be a
+	// sub-slice of dst if dst was large enough to hold the entire decoded
+	// form. Otherwise, a newly allocated slice will be returned.
+	Decode(dst, src []byte) ([]byte, error)
+
+	// MaxEncodedLen returns the maximum length of the encoded form of n
+	// bytes.
+	MaxEncodedLen(n int) int
+}
+
+type zappyCodec struct{}
+
+func (zappyCodec) Encode(dst, src []byte) ([]byte, error) { return zappy.Encode(dst, src) }
+func (zappyCodec) Decode(dst, src []byte) ([]byte, error) { return zappy.Decode(dst, src) }
+func (zappyCodec) MaxEncodedLen(n int) int                { return zappy.MaxEncodedLen(n) }
+
+var codecs = struct {
+	sync.RWMutex
+	m map[byte]Codec
+}{m: map[byte]Codec{tagCompressed: zappyCodec{}}}
+
+// RegisterCodec registers c as the codec of the used blocks with the tail tag
+// cc. The CC values 0 (no compression) and 1 (zappy) are predefined, cc must
+// be in [2, 0xFD] and cannot be registered more than once. Values 0xFE and
+// 0xFF are reserved, they are the tail tags of free blocks.
+//
+// An Allocator reads the blocks of all registered codecs. It uses the codec
+// selected by Options.Compression to write blocks. A file using a registered
+// codec cannot be read by a process which has not registered the same codec
+// for the same cc.
+//
+// RegisterCodec is typically invoked from an init function, it must be
+// invoked before any Allocator reads or writes blocks using cc.
+func RegisterCodec(cc byte, c Codec) error {
+	if cc < minCodecCC || cc > maxCodecCC {
+		return &ErrINVAL{"RegisterCodec: CC out of limits", cc}
+	}
+
+	if c == nil {
+		return &ErrINVAL{"RegisterCodec: nil codec for CC", cc}
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, ok := codecs.m[cc]; ok {
+		return &ErrINVAL{"RegisterCodec: CC already registered", cc}
+	}
+
+	codecs.m[cc] = c
+	return nil
+}
+
+// codec returns the codec registered for cc or nil if there is no such codec.
+func codec(cc byte) Codec {
+	codecs.RLock()
+	c := codecs.m[cc]
+	codecs.RUnlock()
+	return c
+}
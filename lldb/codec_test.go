@@ -0,0 +1,125 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+const testCodecCC = 0x42
+
+// rleCodec encodes runs of equal bytes as (run length, byte) pairs.
+type rleCodec struct{}
+
+func (rleCodec) Encode(dst, src []byte) ([]byte, error) {
+	dst = dst[:0]
+	for len(src) != 0 {
+		c, n := src[0], 1
+		for n < len(src) && n < 255 && src[n] == c {
+			n++
+		}
+		dst = append(dst, byte(n), c)
+		src = src[n:]
+	}
+	return dst, nil
+}
+
+func (rleCodec) Decode(dst, src []byte) ([]byte, error) {
+	if len(src)%2 != 0 {
+		return nil, errors.New("rleCodec: odd encoded length")
+	}
+
+	dst = dst[:0]
+	for ; len(src) != 0; src = src[2:] {
+		if src[0] == 0 {
+			return nil, errors.New("rleCodec: zero run length")
+		}
+
+		for i := 0; i < int(src[0]); i++ {
+			dst = append(dst, src[1])
+		}
+	}
+	return dst, nil
+}
+
+func (rleCodec) MaxEncodedLen(n int) int { return 2 * n }
+
+func init() {
+	if err := RegisterCodec(testCodecCC, rleCodec{}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	for _, cc := range []byte{tagNotCompressed, tagCompressed, testCodecCC, tagFreeShort, tagFreeLong} {
+		if err := RegisterCodec(cc, rleCodec{}); err == nil {
+			t.Fatal(cc)
+		}
+	}
+
+	if err := RegisterCodec(testCodecCC+1, nil); err == nil {
+		t.Fatal("nil codec accepted")
+	}
+
+	if _, err := NewAllocator(NewMemFiler(), &Options{Compression: testCodecCC + 1}); err == nil {
+		t.Fatal("unregistered codec accepted")
+	}
+}
+
+func TestAllocatorCodec(t *testing.T) {
+	const N = 500
+
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{Compression: testCodecCC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Compress {
+		t.Fatal(a.Compress)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	ref := map[int64][]byte{}
+	for i := 0; i < N; i++ {
+		b := bytes.Repeat([]byte{byte(rng.Intn(3))}, rng.Intn(2*maxShort))
+		b = append(b, rndBytes(rng, rng.Intn(20))...)
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+
+	// Check using a new Allocator, with the default options, to bypass the
+	// cache.
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var st AllocStats
+	if err = a.Verify(NewMemFiler(), nil, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Compression == 0 {
+		t.Fatal(st.Compression)
+	}
+
+	for h, e := range ref {
+		g, err := a.Get(nil, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(g, e) {
+			t.Fatalf("handle %d: data mismatch", h)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Named BTree collations.
+
+package lldb
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+)
+
+var collations = struct {
+	sync.RWMutex
+	m     map[string]func(a, b []byte) int
+	names map[uintptr]string // Function -> name.
+}{m: map[string]func(a, b []byte) int{}, names: map[uintptr]string{}}
+
+// RegisterCollation registers collate as the collation named name.
+// CreateBTree records the name of the collation of the tree, if it's
+// registered, and OpenBTree refuses to open such tree using any other
+// collation. Name cannot be empty or start with a zero byte and neither name
+// nor collate can be registered more than once.
+//
+// Collations are identified by their functions. Closures created by the same
+// function literal are not distinguished, a collation should thus be a top
+// level function. A nil collation of CreateBTree and OpenBTree is
+// bytes.Compare.
+//
+// A collation must never change the ordering of keys it defines once it is
+// used by a tree, a new ordering needs a new name.
+//
+// RegisterCollation is typically invoked from an init function, it must be
+// invoked before any tree using name is created or opened.
+func RegisterCollation(name string, collate func(a, b []byte) int) error {
+	if name == "" {
+		return &ErrINVAL{"RegisterCollation: empty collation name", name}
+	}
+
+	if name[0] == 0 {
+		return &ErrINVAL{"RegisterCollation: collation name starts with a zero byte", name}
+	}
+
+	if collate == nil {
+		return &ErrINVAL{"RegisterCollation: nil collation", name}
+	}
+
+	collations.Lock()
+	defer collations.Unlock()
+
+	if _, ok := collations.m[name]; ok {
+		return &ErrINVAL{"RegisterCollation: collation already registered", name}
+	}
+
+	fn := reflect.ValueOf(collate).Pointer()
+	if other, ok := collations.names[fn]; ok {
+		return &ErrINVAL{"RegisterCollation: function already registered as", other}
+	}
+
+	collations.m[name] = collate
+	collations.names[fn] = name
+	return nil
+}
+
+// collation returns the collation registered as name or nil if there is no
+// such collation.
+func collation(name string) func(a, b []byte) int {
+	collations.RLock()
+	c := collations.m[name]
+	collations.RUnlock()
+	return c
+}
+
+// collationName returns the name collate is registered as or "" if it's not
+// registered.
+func collationName(collate func(a, b []byte) int) string {
+	if collate == nil {
+		collate = bytes.Compare
+	}
+	fn := reflect.ValueOf(collate).Pointer()
+	collations.RLock()
+	name := collations.names[fn]
+	collations.RUnlock()
+	return name
+}
@@ -0,0 +1,164 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func bytesCollate(a, b []byte) int { return bytes.Compare(a, b) }
+
+func reverseCollate(a, b []byte) int { return bytes.Compare(b, a) }
+
+func init() {
+	for name, c := range map[string]func(a, b []byte) int{
+		"test-bytes":   bytesCollate,
+		"test-reverse": reverseCollate,
+	} {
+		if err := RegisterCollation(name, c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestRegisterCollation(t *testing.T) {
+	for _, name := range []string{"", "\x00test", "test-bytes"} {
+		if err := RegisterCollation(name, bytes.Compare); err == nil {
+			t.Fatal(name)
+		}
+	}
+
+	if err := RegisterCollation("test-nil", nil); err == nil {
+		t.Fatal("nil collation accepted")
+	}
+
+	if err := RegisterCollation("test-reverse2", reverseCollate); err == nil {
+		t.Fatal("collation registered twice")
+	}
+
+	a, err := NewAllocator(NewMemFiler(), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CreateBTreeCollation(a, "test-nil"); err == nil {
+		t.Fatal("unregistered collation accepted")
+	}
+}
+
+func TestBTreeCollation(t *testing.T) {
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, h, err := CreateBTreeCollation(a, "test-reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 3 * kData
+	for i := 0; i < N; i++ {
+		if err = bt.Set(n2b(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collationErr := func(err error, tree, open string) {
+		e, ok := err.(*ErrCollation)
+		if !ok {
+			t.Fatalf("%T %v", err, err)
+		}
+
+		if e.Handle != h || e.Tree != tree || e.Open != open {
+			t.Fatal(e)
+		}
+	}
+
+	// The root page changes do not lose the recorded collation.
+	for _, first := range []int{N - 1, kData} {
+		_, err = OpenBTree(a, bytesCollate, h)
+		collationErr(err, "test-reverse", "test-bytes")
+		_, err = OpenBTree(a, nil, h)
+		collationErr(err, "test-reverse", "")
+		_, err = OpenBTreeCollation(a, "test-bytes", h)
+		collationErr(err, "test-reverse", "test-bytes")
+		if _, err = OpenBTreeCollation(a, "test-reverse", h); err != nil {
+			t.Fatal(err)
+		}
+
+		if bt, err = OpenBTree(a, reverseCollate, h); err != nil {
+			t.Fatal(err)
+		}
+
+		k, _, err := bt.First()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := b2n(k), first; g != e {
+			t.Fatal(g, e)
+		}
+
+		if err = bt.DeleteRange(nil, n2b(kData)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = bt.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenBTree(a, nil, h); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = RemoveBTree(a, h); err != nil {
+		t.Fatal(err)
+	}
+
+	// CreateBTree records the name of a registered collation.
+	if _, h, err = CreateBTree(a, bytesCollate); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBTree(a, reverseCollate, h)
+	collationErr(err, "test-bytes", "test-reverse")
+	if _, err = OpenBTreeCollation(a, "test-bytes", h); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RemoveBTree(a, h); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tree without a named collation.
+	if _, h, err = CreateBTree(a, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBTreeCollation(a, "test-bytes", h)
+	collationErr(err, "", "test-bytes")
+	for _, c := range []func(a, b []byte) int{nil, reverseCollate} {
+		if _, err = OpenBTree(a, c, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = RemoveBTree(a, h); err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, _ := f.Size(); sz != sz0 {
+		t.Fatal(sz, sz0)
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Filer encrypting its content using AES-XTS.
+
+package lldb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cznic/bufs"
+	"github.com/cznic/fileutil"
+)
+
+var (
+	_ Filer  = &EncryptedFiler{} // Ensure EncryptedFiler is a Filer.
+	_ OSFile = &EncryptedFiler{} // ... and an OSFile.
+)
+
+const (
+	encBits = 9
+	encSize = 1 << encBits
+	encMask = encSize - 1
+
+	encMagic    = "lldbXTS0"
+	encCheckSec = 1<<64 - 1 // Key check block sector number.
+)
+
+var encZeroPage [encSize]byte
+
+// xts implements the AES-XTS mode (IEEE P1619) for data units of a whole
+// number of AES blocks.
+type xts struct {
+	k1, k2 cipher.Block
+}
+
+func newXTS(key []byte) (x *xts, err error) {
+	n := len(key) / 2
+	x = &xts{}
+	if x.k1, err = aes.NewCipher(key[:n]); err != nil {
+		return nil, err
+	}
+
+	if x.k2, err = aes.NewCipher(key[n:]); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (x *xts) crypt(dst, src []byte, sector uint64, decrypt bool) {
+	var t [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(t[:], sector)
+	x.k2.Encrypt(t[:], t[:])
+	for i := 0; i < len(src); i += aes.BlockSize {
+		d, s := dst[i:i+aes.BlockSize], src[i:i+aes.BlockSize]
+		for j, v := range t {
+			d[j] = s[j] ^ v
+		}
+		switch {
+		case decrypt:
+			x.k1.Decrypt(d, d)
+		default:
+			x.k1.Encrypt(d, d)
+		}
+		for j, v := range t {
+			d[j] ^= v
+		}
+
+		// t *= α in GF(2^128)
+		c := t[15] >> 7
+		for j := 15; j > 0; j-- {
+			t[j] = t[j]<<1 | t[j-1]>>7
+		}
+		t[0] = t[0]<<1 ^ 0x87*c
+	}
+}
+
+// EncryptedFiler is a Filer which encrypts the content of the wrapped Filer
+// using AES-XTS, the IEEE P1619 tweakable mode designed for storage devices.
+// The data are encrypted in 512 byte pages, the page number is used as the
+// tweak. Writing only a part of a page reads, decrypts, updates, encrypts and
+// writes back the whole page.
+//
+// The wrapped Filer starts with a single unencrypted header page recording a
+// magic, the (logical) size of the EncryptedFiler and a key check value. The
+// encrypted pages follow. A page of the wrapped Filer consisting only of zero
+// bytes, like eg. a hole, is not decrypted, but read as a page of zeros.
+//
+// The page size equals the traditional disk sector size and pages are aligned
+// to it, so a torn write is assumed to never corrupt a part of a page.
+//
+// EncryptedFiler implements BeginUpdate, EndUpdate and Rollback by invoking
+// them on the wrapped Filer. To reach structural consistency, wrap an
+// EncryptedFiler in eg. a RollbackFiler or ACIDFiler0.
+//
+// EncryptedFiler additionally implements OSFile, so it can be used as the
+// write ahead log of an ACIDFiler0. To encrypt everything an ACIDFiler0
+// writes:
+//
+//	db, err := lldb.NewEncryptedFiler(lldb.NewSimpleFileFiler(dbFile), dbKey)
+//	...
+//	wal, err := lldb.NewEncryptedFiler(lldb.NewSimpleFileFiler(walFile), walKey)
+//	...
+//	filer, err := lldb.NewACIDFiler(db, wal)
+//
+// It's recommended to use different keys for different files.
+type EncryptedFiler struct {
+	f    Filer
+	off  int64 // File pointer for the OSFile methods.
+	size int64
+	x    *xts
+}
+
+// NewEncryptedFiler returns a new EncryptedFiler wrapping f. The key must be
+// 32, 48 or 64 bytes long, selecting AES-128, AES-192 or AES-256 XTS. The
+// first and second half of the key must differ.
+//
+// If f is of zero size, the header is created. Otherwise the header is
+// loaded and the key is checked, a wrong key is reported as an *ErrPERM.
+func NewEncryptedFiler(f Filer, key []byte) (r *EncryptedFiler, err error) {
+	if n := len(key); n != 32 && n != 48 && n != 64 || bytes.Equal(key[:n/2], key[n/2:]) {
+		return nil, &ErrINVAL{"lldb.NewEncryptedFiler: invalid key", len(key)}
+	}
+
+	x, err := newXTS(key)
+	if err != nil {
+		return
+	}
+
+	r = &EncryptedFiler{f: f, x: x}
+	sz, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	if sz != 0 {
+		if err = r.loadHeader(); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}
+
+	var hdr [encSize]byte
+	copy(hdr[:], encMagic)
+	r.x.crypt(hdr[16:32], hdr[16:32], encCheckSec, false)
+	if err = f.BeginUpdate(); err != nil {
+		return nil, err
+	}
+
+	if _, err = f.WriteAt(hdr[:], 0); err != nil {
+		f.Rollback()
+		return nil, err
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (f *EncryptedFiler) loadHeader() (err error) {
+	var hdr [32]byte
+	if n, err := f.f.ReadAt(hdr[:], 0); n != len(hdr) {
+		return &ErrILSEQ{Type: ErrOther, Name: f.Name(), More: err}
+	}
+
+	if string(hdr[:len(encMagic)]) != encMagic {
+		return &ErrILSEQ{Type: ErrOther, Name: f.Name(), More: "invalid encrypted file header"}
+	}
+
+	var check [16]byte
+	f.x.crypt(check[:], check[:], encCheckSec, false)
+	if !bytes.Equal(check[:], hdr[16:32]) {
+		return &ErrPERM{f.Name() + ": invalid encryption key"}
+	}
+
+	f.size = int64(binary.BigEndian.Uint64(hdr[8:]))
+	return nil
+}
+
+func (f *EncryptedFiler) setSize(sz int64) (err error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(sz))
+	if _, err = f.f.WriteAt(b[:], 8); err != nil {
+		return
+	}
+
+	f.size = sz
+	return
+}
+
+// readPage reads and decrypts page pgI into b.
+func (f *EncryptedFiler) readPage(b []byte, pgI int64) (err error) {
+	n, err := f.f.ReadAt(b, (pgI+1)<<encBits)
+	if n != len(b) {
+		if n != 0 || !fileutil.IsEOF(err) {
+			return &ErrILSEQ{Type: ErrOther, Off: pgI << encBits, Name: f.Name(), More: err}
+		}
+
+		copy(b, encZeroPage[:])
+		return nil
+	}
+
+	if bytes.Equal(b, encZeroPage[:]) {
+		return nil
+	}
+
+	f.x.crypt(b, b, uint64(pgI), true)
+	return nil
+}
+
+// writePage encrypts b in place and writes it as page pgI.
+func (f *EncryptedFiler) writePage(b []byte, pgI int64) (err error) {
+	f.x.crypt(b, b, uint64(pgI), false)
+	n, err := f.f.WriteAt(b, (pgI+1)<<encBits)
+	if n != len(b) && err == nil {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+// BeginUpdate implements Filer.
+func (f *EncryptedFiler) BeginUpdate() error {
+	return f.f.BeginUpdate()
+}
+
+// Close implements Filer.
+func (f *EncryptedFiler) Close() error {
+	return f.f.Close()
+}
+
+// EndUpdate implements Filer.
+func (f *EncryptedFiler) EndUpdate() error {
+	return f.f.EndUpdate()
+}
+
+// Name implements Filer.
+func (f *EncryptedFiler) Name() string {
+	return f.f.Name()
+}
+
+// PunchHole implements Filer. Only the pages completely inside the
+// requested range are punched.
+func (f *EncryptedFiler) PunchHole(off, size int64) (err error) {
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	if size < 0 || off+size > f.size {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	first, last := (off+encMask)>>encBits, (off+size)>>encBits
+	if first >= last {
+		return
+	}
+
+	return f.f.PunchHole((first+1)<<encBits, (last-first)<<encBits)
+}
+
+// ReadAt implements Filer.
+func (f *EncryptedFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":ReadAt invalid off", off}
+	}
+
+	avail := f.size - off
+	if avail <= 0 {
+		return 0, io.EOF
+	}
+
+	rem := len(b)
+	if int64(rem) > avail {
+		rem = int(avail)
+		err = io.EOF
+	}
+	pg := bufs.GCache.Get(encSize)
+	defer bufs.GCache.Put(pg)
+	pgI, pgO := off>>encBits, int(off&encMask)
+	for rem != 0 {
+		if err2 := f.readPage(pg, pgI); err2 != nil {
+			return n, err2
+		}
+
+		nc := copy(b[n:n+rem], pg[pgO:])
+		pgI++
+		pgO = 0
+		rem -= nc
+		n += nc
+	}
+	return
+}
+
+// Rollback implements Filer.
+func (f *EncryptedFiler) Rollback() (err error) {
+	if err = f.f.Rollback(); err != nil {
+		return
+	}
+
+	return f.loadHeader()
+}
+
+// Size implements Filer.
+func (f *EncryptedFiler) Size() (int64, error) {
+	return f.size, nil
+}
+
+// Sync implements Filer.
+func (f *EncryptedFiler) Sync() error {
+	return f.f.Sync()
+}
+
+// Truncate implements Filer.
+func (f *EncryptedFiler) Truncate(size int64) (err error) {
+	if size < 0 {
+		return &ErrINVAL{"Truncate size", size}
+	}
+
+	if size < f.size {
+		if o := int(size & encMask); o != 0 { // Zero the tail of the new last page.
+			pg := bufs.GCache.Get(encSize)
+			defer bufs.GCache.Put(pg)
+			pgI := size >> encBits
+			if err = f.readPage(pg, pgI); err != nil {
+				return
+			}
+
+			copy(pg[o:], encZeroPage[:])
+			if err = f.writePage(pg, pgI); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = f.f.Truncate((size+encMask)&^encMask + encSize); err != nil {
+		return
+	}
+
+	return f.setSize(size)
+}
+
+// WriteAt implements Filer.
+func (f *EncryptedFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":WriteAt invalid off", off}
+	}
+
+	pg := bufs.GCache.Get(encSize)
+	defer bufs.GCache.Put(pg)
+	pgI, pgO := off>>encBits, int(off&encMask)
+	for rem := len(b); rem != 0; {
+		nc := encSize - pgO
+		if nc > rem {
+			nc = rem
+		}
+		if nc != encSize {
+			if pgI<<encBits < f.size {
+				if err = f.readPage(pg, pgI); err != nil {
+					return
+				}
+			} else {
+				copy(pg, encZeroPage[:])
+			}
+		}
+		copy(pg[pgO:], b[n:n+nc])
+		if err = f.writePage(pg, pgI); err != nil {
+			return
+		}
+
+		pgI++
+		pgO = 0
+		rem -= nc
+		n += nc
+	}
+
+	if end := off + int64(n); end > f.size {
+		err = f.setSize(end)
+	}
+	return
+}
+
+// Read implements OSFile.
+func (f *EncryptedFiler) Read(b []byte) (n int, err error) {
+	n, err = f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// Seek implements OSFile.
+func (f *EncryptedFiler) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += f.off
+	case 2:
+		offset += f.size
+	default:
+		return f.off, &ErrINVAL{f.Name() + ": Seek whence", whence}
+	}
+	if offset < 0 {
+		return f.off, &ErrINVAL{f.Name() + ": Seek offset", offset}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+// Stat implements OSFile.
+func (f *EncryptedFiler) Stat() (os.FileInfo, error) {
+	return filerFileInfo{f.Name(), f.size}, nil
+}
+
+// Write implements OSFile.
+func (f *EncryptedFiler) Write(b []byte) (n int, err error) {
+	n, err = f.WriteAt(b, f.off)
+	f.off += int64(n)
+	return
+}
+
+// filerFileInfo is the os.FileInfo of a Filer.
+type filerFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi filerFileInfo) IsDir() bool        { return false }
+func (fi filerFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi filerFileInfo) Mode() os.FileMode  { return 0 }
+func (fi filerFileInfo) Name() string       { return fi.name }
+func (fi filerFileInfo) Size() int64        { return fi.size }
+func (fi filerFileInfo) Sys() interface{}   { return nil }
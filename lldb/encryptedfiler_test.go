@@ -0,0 +1,244 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+var testEncKey = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!?")
+
+var newEncryptedFiler = func() Filer {
+	f, err := NewEncryptedFiler(NewMemFiler(), testEncKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+func TestEncryptedFiler(t *testing.T) {
+	testFilerNesting(t, newEncryptedFiler)
+	testFilerTruncate(t, newEncryptedFiler)
+	testFilerReadAtWriteAt(t, newEncryptedFiler)
+	testInnerFiler(t, newEncryptedFiler)
+	testFileReadAtHole(t, newEncryptedFiler)
+}
+
+// IEEE P1619/D16, Annex B, XTS-AES-128 vectors 1 and 2.
+func TestXTS(t *testing.T) {
+	tab := []struct {
+		key    string
+		sector uint64
+		pt, ct string
+	}{
+		{
+			"00000000000000000000000000000000" + "00000000000000000000000000000000",
+			0,
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e",
+		},
+		{
+			"11111111111111111111111111111111" + "22222222222222222222222222222222",
+			0x3333333333,
+			"4444444444444444444444444444444444444444444444444444444444444444",
+			"c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0",
+		},
+	}
+	for i, test := range tab {
+		key, _ := hex.DecodeString(test.key)
+		pt, _ := hex.DecodeString(test.pt)
+		ct, _ := hex.DecodeString(test.ct)
+		x, err := newXTS(key)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		b := make([]byte, len(pt))
+		x.crypt(b, pt, test.sector, false)
+		if !bytes.Equal(b, ct) {
+			t.Fatalf("%d\n%x\n%x", i, b, ct)
+		}
+
+		x.crypt(b, b, test.sector, true)
+		if !bytes.Equal(b, pt) {
+			t.Fatalf("%d\n%x\n%x", i, b, pt)
+		}
+	}
+}
+
+func TestEncryptedFilerKey(t *testing.T) {
+	for _, n := range []int{0, 16, 31, 33, 65} {
+		if _, err := NewEncryptedFiler(NewMemFiler(), make([]byte, n)); err == nil {
+			t.Fatal(n)
+		}
+	}
+
+	if _, err := NewEncryptedFiler(NewMemFiler(), make([]byte, 32)); err == nil {
+		t.Fatal("equal key halves accepted")
+	}
+
+	mf := NewMemFiler()
+	f, err := NewEncryptedFiler(mf, testEncKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := bytes.Repeat([]byte("top secret "), 100)
+	if _, err = f.WriteAt(secret, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := filerBytes(mf); bytes.Contains(b, secret[:16]) {
+		t.Fatal("plain text leaked")
+	}
+
+	key := append([]byte(nil), testEncKey...)
+	key[0] ^= 1
+	if _, err = NewEncryptedFiler(mf, key); err == nil {
+		t.Fatal("wrong key accepted")
+	}
+
+	if f, err = NewEncryptedFiler(mf, testEncKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, _ := f.Size(); sz != int64(len(secret))+1000 {
+		t.Fatal(sz)
+	}
+
+	b := make([]byte, len(secret))
+	if _, err = f.ReadAt(b, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, secret) {
+		t.Fatal("data mismatch")
+	}
+}
+
+// Both the DB and the WAL of an ACIDFiler0 encrypted.
+func TestEncryptedFilerACID(t *testing.T) {
+	const N = 1 << 11
+
+	dir, err := ioutil.TempDir("", "lldb-test-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	open := func(name string) *EncryptedFiler {
+		file, err := os.OpenFile(dir+"/"+name, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := NewEncryptedFiler(NewSimpleFileFiler(file), testEncKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f
+	}
+
+	db, wal := open("db"), open("wal")
+	f, err := NewACIDFiler(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, h, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var k, v [8]byte
+	for i := 0; i < N; i++ {
+		if i%100 == 0 {
+			if err = f.BeginUpdate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		binary.BigEndian.PutUint64(k[:], uint64(rng.Int63()))
+		binary.BigEndian.PutUint64(v[:], uint64(i))
+		if err = tr.Set(k[:], v[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%100 == 99 || i == N-1 {
+			if err = f.EndUpdate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if f.PeakWALSize() == 0 {
+		t.Fatal("WAL not used")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, wal = open("db"), open("wal")
+	defer db.Close()
+	defer wal.Close()
+
+	if f, err = NewACIDFiler(db, wal); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr, err = OpenBTree(a, nil, h); err != nil {
+		t.Fatal(err)
+	}
+
+	rng.Seed(42)
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(rng.Int63()))
+		binary.BigEndian.PutUint64(v[:], uint64(i))
+		g, err := tr.Get(nil, k[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(g, v[:]) {
+			t.Fatal(i, g, v)
+		}
+	}
+}
@@ -13,6 +13,26 @@ import (
 	"fmt"
 )
 
+// ErrCollation reports a BTree opened using another collation than the one
+// recorded in the tree. See CreateBTree.
+type ErrCollation struct {
+	Handle int64  // Handle of the tree.
+	Tree   string // Collation recorded in the tree. Empty if none.
+	Open   string // Collation used to open the tree. Empty if none.
+}
+
+// Error implements the built in error type.
+func (e *ErrCollation) Error() string {
+	name := func(s string) string {
+		if s == "" {
+			return "no named collation"
+		}
+
+		return fmt.Sprintf("collation %q", s)
+	}
+	return fmt.Sprintf("BTree %#x: tree has %s, opened with %s", e.Handle, name(e.Tree), name(e.Open))
+}
+
 // ErrDecodeScalars is possibly returned from DecodeScalars
 type ErrDecodeScalars struct {
 	B []byte // Data being decoded
@@ -24,6 +44,23 @@ func (e *ErrDecodeScalars) Error() string {
 	return fmt.Sprintf("DecodeScalars: corrupted data @ %d/%d", e.I, len(e.B))
 }
 
+// ErrGeneration reports, in the handle generations mode, a handle which
+// generation does not match the generation of the block it refers to, ie. a
+// dangling handle. See Options.Generations.
+type ErrGeneration struct {
+	Handle int64 // Handle, including its generation.
+	Gen    byte  // Generation of the block. Zero if the block is free.
+}
+
+// Error implements the built in error type.
+func (e *ErrGeneration) Error() string {
+	if e.Gen == 0 {
+		return fmt.Sprintf("Handle %#x, generation %d: Block is free", e.Handle&maxHandle, e.Handle>>genShift)
+	}
+
+	return fmt.Sprintf("Handle %#x, generation %d: Block generation is %d", e.Handle&maxHandle, e.Handle>>genShift, e.Gen)
+}
+
 // ErrINVAL reports invalid values passed as parameters, for example negative
 // offsets where only non-negative ones are allowed or read from the DB.
 type ErrINVAL struct {
@@ -83,6 +120,11 @@ const (
 	ErrVerifyPadding         // Used block has nonzero padding
 	ErrVerifyTailSize        // Long free block size .Arg but tail size .Arg2
 	ErrVerifyUsedSpan        // Used block size (.Arg) spans beyond EOF
+
+	// New ErrTypes go below, keeping the values above stable.
+	ErrChecksum   // Page at .Off of file .Name has invalid checksum
+	ErrLargeIndex // Invalid large block index block at .Off, .More: more
+	ErrBTree      // Invalid BTree page at .Off, .More: more
 )
 
 // ErrILSEQ reports a corrupted file format. Details in fields according to Type.
@@ -101,6 +143,10 @@ func (e *ErrILSEQ) Error() string {
 	switch e.Type {
 	case ErrAdjacentFree:
 		return fmt.Sprintf("Adjacent free blocks at offset %#x and %#x", e.Off, e.Arg)
+	case ErrBTree:
+		return fmt.Sprintf("BTree page at offset %#x: %v", e.Off, e.More)
+	case ErrChecksum:
+		return fmt.Sprintf("File %q, page at offset %#x: Checksum mismatch", e.Name, e.Off)
 	case ErrDecompress:
 		return fmt.Sprintf("Compressed block at offset %#x: Corrupted compressed content", e.Off)
 	case ErrExpFreeTag:
@@ -125,6 +171,8 @@ func (e *ErrILSEQ) Error() string {
 		return fmt.Sprintf("Used reloc block at offset %#x: Target (%#x) is not a short or long used block", e.Off, e.Arg)
 	case ErrInvalidWAL:
 		return fmt.Sprintf("Corrupted write ahead log file: %q %v", e.Name, e.More)
+	case ErrLargeIndex:
+		return fmt.Sprintf("Large block index block at offset %#x: %v", e.Off, e.More)
 	case ErrLongFreeBlkTooLong:
 		return fmt.Sprintf("Long free block at offset %#x: Size (%#x) beyond EOF", e.Off, e.Arg)
 	case ErrLongFreeBlkTooShort:
@@ -8,6 +8,7 @@ package lldb
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,11 +18,13 @@ import (
 
 	"github.com/cznic/bufs"
 	"github.com/cznic/mathutil"
-	"github.com/cznic/zappy"
 )
 
 const (
-	maxBuf = maxRq + 20 // bufs,Buffers.Alloc
+	maxBuf    = maxRq + 20 // bufs,Buffers.Alloc
+	punchSize = 1 << 12    // Granularity of holes punched in free blocks.
+	genShift  = 56         // Position of the generation in a handle.
+	maxGen    = 127        // Generations are in [1, maxGen].
 )
 
 // Options are passed to the NewAllocator to amend some configuration.  The
@@ -30,11 +33,43 @@ const (
 // fields, which is backward compatible as long as client code uses field names
 // to assign values of imported struct types literals.
 //
-// NOTE: No options are currently defined.
-type Options struct{}
+// The zero value of Options selects the defaults.
+type Options struct {
+	// CacheSize is the maximum number of blocks the Allocator keeps in its
+	// block cache. Zero selects the default cache, which size adapts to the
+	// cache hit ratio, up to 500 blocks. A negative value disables the
+	// cache.
+	CacheSize int
+
+	// CacheBytes, if positive, limits the total size of the content of the
+	// blocks in the block cache. Blocks bigger than CacheBytes are not
+	// cached.
+	CacheBytes int64
+
+	// Compression, if non zero, is the CC value of the codec used to
+	// compress the content of written blocks. It sets Allocator.Compress.
+	// CC == 1 selects zappy, other values select a codec registered by
+	// RegisterCodec. See the 'Content compression' subtitle in the
+	// Allocator documentation.
+	Compression byte
+
+	// WipeOnFree makes the Allocator overwrite the former content of
+	// deallocated blocks with zeros. See the 'Content wiping' subtitle in
+	// the Allocator documentation.
+	WipeOnFree bool
+
+	// Generations enables the handle generations mode. Every used block
+	// then carries a generation, which is also a part of the handle
+	// returned by Alloc. Get, Realloc and Free return an *ErrGeneration
+	// if the generations do not match. See the 'Handle generations'
+	// subtitle in the Allocator documentation. A file written in this
+	// mode must be always opened in this mode.
+	Generations bool
+}
 
 // AllocStats record statistics about a Filer. It can be optionally filled by
-// Allocator.Verify, if successful.
+// Allocator.Verify, if successful. Allocator.Stats returns some of them
+// without verifying the Filer.
 type AllocStats struct {
 	Handles     int64           // total valid handles in use
 	Compression int64           // number of compressed blocks
@@ -141,7 +176,13 @@ Content wiping
 When a block is deallocated, its data content is not wiped as the added
 overhead may be substantial while not necessarily needed. Client code should
 however overwrite the content of any block having sensitive data with eg. zeros
-(good compression) - before deallocating the block.
+(good compression) - before deallocating the block. Alternatively, the
+Allocator wipes every block it deallocates, either by Free or by Realloc
+shrinking or relocating the block, if Options.WipeOnFree is set. The blocks are
+overwritten with zeros, except for the whole 4kB pages in the Leak field, which
+are released by punching holes, see the 'A long unused block' subtitle below.
+If the Filer passed to NewAllocator is an ACIDFiler0, the WAL is overwritten
+with zeros as well before it is truncated after every transaction.
 
 Block tags
 
@@ -168,6 +209,9 @@ The tail flag of an used block is one of
 
 	CC == 0 // Content is not compressed.
 	CC == 1 // Content is in zappy compression format.
+	CC == 2...0xFD // Content is in the format of a codec registered by RegisterCodec.
+
+CC MUST NOT be 0xFE or 0xFF, those are the tail tags of free blocks.
 
 If compression of written content is enabled, there are two cases: If
 compressed size < original size then the compressed content should be written
@@ -269,8 +313,65 @@ S is the size of this unused block in atoms. P and N are the previous and next
 free block handles in the doubly linked list to which this free block belongs.
 Leak contains any data the block had before deallocating this block.  See also
 the subtitle 'Content wiping' above. S, P and N are stored in network byte
-order. Large free blocks may trigger a consideration of file hole punching of
-the Leak field - for some value of 'large'.
+order. When freeing a block, all the 4kB pages within its former content
+which fall into the Leak field are released by punching a hole in the file.
+See Filer.PunchHole.
+
+Large blocks
+
+Content too big to fit in a single block can be stored in a large block, see
+AllocLarge. A large block is referred to by the handle of its index block.
+The content of the index block is the size of the large block content, 8
+bytes in network byte order, followed by the 7 byte handles of the chunks
+holding the content, also in network byte order.
+
+	+------+--------+--------+- ... -+--------+
+	| 0..7 |  8..14 | 15..21 |       |        |
+	+------+--------+--------+- ... -+--------+
+	| Size | Chunk0 | Chunk1 |       | ChunkN |
+	+------+--------+--------+- ... -+--------+
+
+Chunks are ordinary used blocks. All chunks, except the last one, hold 64kB
+(65536 bytes) of the content. The last chunk holds the rest, there are no
+empty chunks. The size of a large block content is thus limited to 9397
+chunks, ie. a little more than 615MB.
+
+Handle generations
+
+In the handle generations mode, see Options.Generations, the first byte of
+the content of every used block is the block generation, a number in [1,
+127]. The generation byte is not visible to the clients of an Allocator. It
+is added by Alloc and Realloc and removed by Get. The content of a block is
+thus limited to 65786 bytes. The block format is otherwise unchanged, the
+generation is compressed together with the rest of the content, if
+compressed.
+
+Alloc assigns the generations cyclically and returns handles with the block
+generation in bits 56 to 62. Get, Realloc and Free compare the generation of
+such handles with the generation of the block. If the generations differ or
+if the block is free, the handle is dangling and an *ErrGeneration is
+returned. A dangling handle is not detected only if the block it referred to
+was allocated again with the same generation, which happens in about one of
+127 cases.
+
+Handles with zero bits 56 to 62 are accepted, but not checked. That is for
+example the case of handles stored in 7 bytes, like in the pages of a BTree
+or in the index block of a large block.
+
+Concurrency
+
+Get is safe for concurrent use by multiple goroutines, also while another
+goroutine invokes a method mutating the file, ie. Alloc, Free, Realloc,
+Compact or Repair. The mutating methods exclude Get while they modify the
+file, so Get observes a block either before or after a mutation, but never
+in between. The block cache is shared by all goroutines.
+
+Only one goroutine may mutate the Allocator at a time. That includes invoking
+the BeginUpdate, EndUpdate and Rollback methods of its Filer, which then run
+concurrently with Get, so they must not interfere with ReadAt. RollbackFiler
+and ACIDFiler0 are safe for concurrent use. Blocks written by a transaction
+which is not yet finished are visible to Get. Rolling back the transaction
+reverts them.
 
 Note: Allocator methods vs CRUD[1]:
 
@@ -291,12 +392,23 @@ type Allocator struct {
 	cache    cache
 	m        map[int64]*node
 	lru      lst
+	lruBytes int64 // content bytes on lru
 	expHit   int64
 	expMiss  int64
 	cacheSz  int
+	cacheMax int         // adaptive cacheSz limit
+	cacheB   int64       // content bytes limit, if > 0
+	cc       byte        // CC used by makeUsedBlock if Compress is set
+	enc      Codec       // Codec of cc
+	stats    *AllocStats // maintained incrementally if not nil
 	hit      uint16
 	miss     uint16
-	mu       sync.Mutex
+	wipe     bool
+	gens     bool         // handle generations mode
+	gen      byte         // last assigned block generation
+	cgen     uint64       // cache generation, incremented by cinit
+	mu       sync.Mutex   // guards the cache
+	rw       sync.RWMutex // Get vs. the mutating methods
 }
 
 // NewAllocator returns a new Allocator. To open an existing file, pass its
@@ -307,8 +419,27 @@ func NewAllocator(f Filer, opts *Options) (a *Allocator, err error) {
 	}
 
 	a = &Allocator{
-		f:       f,
-		cacheSz: 10,
+		f:        f,
+		cacheSz:  10,
+		cacheMax: 500,
+		cacheB:   opts.CacheBytes,
+		cc:       tagCompressed,
+		enc:      zappyCodec{},
+		wipe:     opts.WipeOnFree,
+		gens:     opts.Generations,
+	}
+	switch n := opts.CacheSize; {
+	case n < 0:
+		a.cacheSz, a.cacheMax = 0, 0
+	case n > 0:
+		a.cacheSz, a.cacheMax = n, n
+	}
+	if cc := opts.Compression; cc != tagNotCompressed {
+		if a.enc = codec(cc); a.enc == nil {
+			return nil, &ErrINVAL{"NewAllocator: unknown compression", cc}
+		}
+
+		a.Compress, a.cc = true, cc
 	}
 
 	a.cinit()
@@ -316,13 +447,16 @@ func NewAllocator(f Filer, opts *Options) (a *Allocator, err error) {
 	case *RollbackFiler:
 		x.afterRollback = func() error {
 			a.cinit()
+			a.stats = nil
 			return a.flt.load(a.f, 0)
 		}
 	case *ACIDFiler0:
 		x.RollbackFiler.afterRollback = func() error {
 			a.cinit()
+			a.stats = nil
 			return a.flt.load(a.f, 0)
 		}
+		x.wipe = x.wipe || a.wipe
 	}
 
 	sz, err := f.Size()
@@ -352,6 +486,11 @@ func NewAllocator(f Filer, opts *Options) (a *Allocator, err error) {
 //
 //TODO return a struct perhaps.
 func (a *Allocator) CacheStats() (buffersUsed, buffersTotal int, bytesUsed, bytesTotal, hits, misses int64) {
+	a.rw.RLock()
+	defer a.rw.RUnlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	buffersUsed = len(a.m)
 	buffersTotal = buffersUsed + len(a.cache)
 	bytesUsed = a.lru.size()
@@ -362,9 +501,12 @@ func (a *Allocator) CacheStats() (buffersUsed, buffersTotal int, bytesUsed, byte
 }
 
 func (a *Allocator) cinit() {
-	for h, n := range a.m {
-		a.cache.put(a.lru.remove(n))
-		delete(a.m, h)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cgen++
+	for _, n := range a.m {
+		a.cremove(n)
 	}
 	if a.m == nil {
 		a.m = map[int64]*node{}
@@ -372,21 +514,20 @@ func (a *Allocator) cinit() {
 }
 
 func (a *Allocator) cadd(b []byte, h int64) {
-	if len(a.m) < a.cacheSz {
-		n := a.cache.get(len(b))
-		n.h = h
-		copy(n.b, b)
-		a.m[h] = a.lru.pushFront(n)
+	if a.cacheSz <= 0 || a.cacheB > 0 && int64(len(b)) > a.cacheB {
 		return
 	}
 
-	// cache full
-	delete(a.m, a.cache.put(a.lru.removeBack()).h)
+	for len(a.m) != 0 && (len(a.m) >= a.cacheSz || a.cacheB > 0 && a.lruBytes+int64(len(b)) > a.cacheB) {
+		// cache full
+		a.cremove(a.lru.back)
+	}
+
 	n := a.cache.get(len(b))
 	n.h = h
 	copy(n.b, b)
 	a.m[h] = a.lru.pushFront(n)
-	return
+	a.lruBytes += int64(len(n.b))
 }
 
 func (a *Allocator) cfree(h int64) {
@@ -395,8 +536,12 @@ func (a *Allocator) cfree(h int64) {
 		return
 	}
 
-	a.cache.put(a.lru.remove(n))
-	delete(a.m, h)
+	a.cremove(n)
+}
+
+func (a *Allocator) cremove(n *node) {
+	a.lruBytes -= int64(len(n.b))
+	delete(a.m, a.cache.put(a.lru.remove(n)).h)
 }
 
 // Alloc allocates storage space for b and returns the handle of the new block
@@ -408,22 +553,53 @@ func (a *Allocator) cfree(h int64) {
 //
 // Invoking Alloc on an empty Allocator is guaranteed to return handle with
 // value 1. The intended use of content of handle 1 is a root "directory" of
-// other data held by an Allocator.
+// other data held by an Allocator. In the handle generations mode, the
+// returned handle additionally includes the block generation.
 //
 // Passing handles not obtained initially from Alloc or not anymore valid to
 // any other Allocator methods can result in an irreparably corrupted database.
 func (a *Allocator) Alloc(b []byte) (handle int64, err error) {
-	buf := bufs.GCache.Get(zappy.MaxEncodedLen(len(b)))
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	var gen byte
+	if a.gens {
+		a.gen = a.gen%maxGen + 1
+		gen = a.gen
+		b = withGen(gen, b)
+		defer bufs.GCache.Put(b)
+	}
+
+	buf := bufs.GCache.Get(a.enc.MaxEncodedLen(len(b)))
 	defer bufs.GCache.Put(buf)
 	buf, _, cc, err := a.makeUsedBlock(buf, b)
 	if err != nil {
 		return
 	}
 
-	if handle, err = a.alloc(buf, cc); err == nil {
-		a.cadd(b, handle)
+	if handle, err = a.alloc(buf, cc); err != nil {
+		a.stats = nil
+		return
 	}
-	return
+
+	a.cadd(b, handle)
+	return handle | int64(gen)<<genShift, a.account(handle, 1)
+}
+
+// withGen returns b prefixed by the generation byte gen. The result should be
+// returned to bufs.GCache.
+func withGen(gen byte, b []byte) []byte {
+	r := bufs.GCache.Get(1 + len(b))
+	r[0] = gen
+	copy(r[1:], b)
+	return r
+}
+
+// validHandle reports whether handle, possibly including a generation, is
+// within limits.
+func (a *Allocator) validHandle(handle int64) bool {
+	h := handle & maxHandle
+	return handle > 0 && h != 0 && (handle == h || a.gens)
 }
 
 func (a *Allocator) alloc(b []byte, cc byte) (h int64, err error) {
@@ -482,12 +658,30 @@ func (a *Allocator) alloc(b []byte, cc byte) (h int64, err error) {
 // Handle must have been obtained initially from Alloc and must be still valid,
 // otherwise a database may get irreparably corrupted.
 func (a *Allocator) Free(handle int64) (err error) {
-	if handle <= 0 || handle > maxHandle {
+	if !a.validHandle(handle) {
 		return &ErrINVAL{"Allocator.Free: handle out of limits", handle}
 	}
 
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	if a.gens {
+		if _, _, err = a.getGen(nil, handle); err != nil {
+			return
+		}
+
+		handle &= maxHandle
+	}
+
 	a.cfree(handle)
-	return a.free(handle, 0, true)
+	if err = a.account(handle, -1); err != nil {
+		return
+	}
+
+	if err = a.free(handle, 0, true); err != nil {
+		a.stats = nil
+	}
+	return
 }
 
 func (a *Allocator) free(h, from int64, acceptRelocs bool) (err error) {
@@ -545,6 +739,12 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 		ratoms = 0
 	}
 
+	if !isTail {
+		if err = a.punch(h, atoms); err != nil {
+			return
+		}
+	}
+
 	switch {
 	case latoms == 0 && ratoms == 0:
 		// -> isolated <-
@@ -592,6 +792,42 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 	return a.link(h-latoms, latoms+atoms+ratoms)
 }
 
+// punch punches a hole in the file for all whole pages of size punchSize
+// within the Leak field of the newly freed block h. Joining h with its free
+// neighbours cannot move the Leak field boundaries inside h. If wiping is
+// enabled, the rest of h is overwritten with zeros. That includes the bytes
+// outside of the Leak field as they are not necessarily overwritten when h is
+// joined with its free neighbours.
+func (a *Allocator) punch(h, atoms int64) (err error) {
+	off, end := h2off(h), h2off(h+atoms)
+	first := (off + 22 + punchSize - 1) &^ (punchSize - 1) // After tag, S, P and N.
+	last := (end - 8) &^ (punchSize - 1)                   // Before S and tag.
+	if first >= last {
+		return a.zero(off, end)
+	}
+
+	if err = a.zero(off, first); err != nil {
+		return
+	}
+
+	if err = a.zero(last, end); err != nil {
+		return
+	}
+
+	return a.f.PunchHole(first, last-first)
+}
+
+// zero overwrites [from, to) with zeros if wiping is enabled.
+func (a *Allocator) zero(from, to int64) (err error) {
+	if !a.wipe || from >= to {
+		return
+	}
+
+	b := bufs.GCache.Cget(int(to - from))
+	defer bufs.GCache.Put(b)
+	return a.writeAt(b, from)
+}
+
 // Add a free block h to the appropriate free list
 func (a *Allocator) link(h, atoms int64) (err error) {
 	if err = a.makeFree(h, atoms, 0, a.flt.head(atoms)); err != nil {
@@ -648,11 +884,63 @@ func need(n int, src []byte) []byte {
 // returned decompressed.
 //
 // Handle must have been obtained initially from Alloc and must be still valid,
-// otherwise invalid data may be returned without detecting the error.
+// otherwise invalid data may be returned without detecting the error, unless
+// the handle generations mode is enabled.
 //
-// Get is safe for concurrent access by multiple goroutines iff no other
-// goroutine mutates the DB.
+// Get is safe for concurrent use by multiple goroutines. See the
+// 'Concurrency' subtitle in the Allocator documentation.
 func (a *Allocator) Get(buf []byte, handle int64) (b []byte, err error) {
+	a.rw.RLock()
+	defer a.rw.RUnlock()
+
+	if a.gens {
+		b, _, err = a.getGen(buf, handle)
+		return
+	}
+
+	return a.get(buf, handle)
+}
+
+// getGen returns the content of the block handle, without the generation
+// byte, and the block generation. If handle includes a generation, it must be
+// the block generation.
+func (a *Allocator) getGen(buf []byte, handle int64) (b []byte, gen byte, err error) {
+	hgen := byte(handle >> genShift)
+	if b, err = a.get(buf, handle&maxHandle); err != nil {
+		if hgen != 0 && a.freed(handle&maxHandle, err) {
+			err = &ErrGeneration{Handle: handle}
+		}
+		return nil, 0, err
+	}
+
+	if len(b) == 0 {
+		return nil, 0, &ErrILSEQ{Type: ErrOther, Off: h2off(handle & maxHandle), More: "missing block generation"}
+	}
+
+	if gen = b[0]; hgen != 0 && hgen != gen {
+		return nil, 0, &ErrGeneration{Handle: handle, Gen: gen}
+	}
+
+	return b[1:], gen, nil
+}
+
+// freed reports whether err, returned by get for h, means that block h is
+// free or beyond the end of the file.
+func (a *Allocator) freed(h int64, err error) bool {
+	e, ok := err.(*ErrILSEQ)
+	if !ok {
+		return false
+	}
+
+	if e.Type == ErrExpUsedTag {
+		return true
+	}
+
+	sz, err := a.f.Size()
+	return err == nil && h2off(h) >= sz
+}
+
+func (a *Allocator) get(buf []byte, handle int64) (b []byte, err error) {
 	buf = buf[:cap(buf)]
 	a.mu.Lock() // X1+
 	if n, ok := a.m[handle]; ok {
@@ -667,18 +955,23 @@ func (a *Allocator) Get(buf []byte, handle int64) (b []byte, err error) {
 
 	a.expMiss++
 	a.miss++
-	if a.miss > 10 && len(a.m) < 500 {
+	if a.miss > 10 && a.cacheSz < a.cacheMax {
 		if 100*a.hit/a.miss < 95 {
 			a.cacheSz++
 		}
 		a.hit, a.miss = 0, 0
 	}
+	gen := a.cgen
 	a.mu.Unlock() // X1-
 
 	defer func(h int64) {
 		if err == nil {
 			a.mu.Lock() // X2+
-			a.cadd(b, h)
+			// Not invalidated by a rollback nor cached by another Get
+			// meanwhile.
+			if _, ok := a.m[h]; !ok && a.cgen == gen {
+				a.cadd(b, h)
+			}
 			a.mu.Unlock() // X2-
 		}
 	}(handle)
@@ -704,14 +997,17 @@ reloc:
 		switch atoms {
 		case 1:
 			switch tag := first[15]; tag {
-			default:
-				return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
 			case tagNotCompressed:
 				b = need(dlen, buf)
 				copy(b, first[1:])
 				return
-			case tagCompressed:
-				return zappy.Decode(buf, first[1:dlen+1])
+			default:
+				c := codec(tag)
+				if c == nil {
+					return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
+				}
+
+				return c.Decode(buf, first[1:dlen+1])
 			}
 		default:
 			cc := bufs.GCache.Get(1)
@@ -724,8 +1020,6 @@ reloc:
 			}
 
 			switch tag := cc[0]; tag {
-			default:
-				return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
 			case tagNotCompressed:
 				b = need(dlen, buf)
 				off += 1
@@ -733,7 +1027,12 @@ reloc:
 					b = buf[:0]
 				}
 				return
-			case tagCompressed:
+			default:
+				c := codec(tag)
+				if c == nil {
+					return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
+				}
+
 				zbuf := bufs.GCache.Get(dlen)
 				defer bufs.GCache.Put(zbuf)
 				off += 1
@@ -741,7 +1040,7 @@ reloc:
 					return buf[:0], err
 				}
 
-				return zappy.Decode(buf, zbuf)
+				return c.Decode(buf, zbuf)
 			}
 		}
 	case 0:
@@ -757,8 +1056,6 @@ reloc:
 		}
 
 		switch tag := cc[0]; tag {
-		default:
-			return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
 		case tagNotCompressed:
 			b = need(dlen, buf)
 			off += 3
@@ -766,7 +1063,12 @@ reloc:
 				b = buf[:0]
 			}
 			return
-		case tagCompressed:
+		default:
+			c := codec(tag)
+			if c == nil {
+				return nil, &ErrILSEQ{Type: ErrTailTag, Off: off, Arg: int64(tag)}
+			}
+
 			zbuf := bufs.GCache.Get(dlen)
 			defer bufs.GCache.Put(zbuf)
 			off += 3
@@ -774,7 +1076,7 @@ reloc:
 				return buf[:0], err
 			}
 
-			return zappy.Decode(buf, zbuf)
+			return c.Decode(buf, zbuf)
 		}
 	case tagFreeShort, tagFreeLong:
 		return nil, &ErrILSEQ{Type: ErrExpUsedTag, Off: off, Arg: int64(tag)}
@@ -797,12 +1099,35 @@ var reallocTestHook bool
 // Handle must have been obtained initially from Alloc and must be still valid,
 // otherwise a database may get irreparably corrupted.
 func (a *Allocator) Realloc(handle int64, b []byte) (err error) {
-	if handle <= 0 || handle > maxHandle {
+	if !a.validHandle(handle) {
 		return &ErrINVAL{"Realloc: handle out of limits", handle}
 	}
 
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	if a.gens {
+		var gen byte
+		if _, gen, err = a.getGen(nil, handle); err != nil {
+			return
+		}
+
+		handle &= maxHandle
+		b = withGen(gen, b)
+		defer bufs.GCache.Put(b)
+	}
+
 	a.cfree(handle)
+	if err = a.account(handle, -1); err != nil {
+		return
+	}
+
 	if err = a.realloc(handle, b); err != nil {
+		a.stats = nil
+		return
+	}
+
+	if err = a.account(handle, 1); err != nil {
 		return
 	}
 
@@ -821,7 +1146,7 @@ func (a *Allocator) realloc(handle int64, b []byte) (err error) {
 
 	b8 := bufs.GCache.Get(8)
 	defer bufs.GCache.Put(b8)
-	dst := bufs.GCache.Get(zappy.MaxEncodedLen(len(b)))
+	dst := bufs.GCache.Get(a.enc.MaxEncodedLen(len(b)))
 	defer bufs.GCache.Put(dst)
 	b, needAtoms0, cc, err := a.makeUsedBlock(dst, b)
 	if err != nil {
@@ -1127,13 +1452,13 @@ func (a *Allocator) makeUsedBlock(dst []byte, b []byte) (w []byte, rqAtoms int,
 
 	rqAtoms = n2atoms(n)
 	if a.Compress && n > 14 { // attempt compression
-		if dst, err = zappy.Encode(dst, b); err != nil {
+		if dst, err = a.enc.Encode(dst, b); err != nil {
 			return
 		}
 
 		n2 := len(dst)
 		if rqAtoms2 := n2atoms(n2); rqAtoms2 < rqAtoms { // compression saved at least a single atom
-			w, n, rqAtoms, cc = dst, n2, rqAtoms2, tagCompressed
+			w, n, rqAtoms, cc = dst, n2, rqAtoms2, a.cc
 		}
 	}
 	return
@@ -1160,6 +1485,779 @@ func (a *Allocator) writeUsedBlock(h int64, cc byte, b []byte) (err error) {
 	return a.writeAt(buf, h2off(h))
 }
 
+// Compact attempts to shrink the file by moving the used blocks at its end
+// into free blocks nearer to the file start. All handles stay valid: A block
+// which is the target of a relocated block is moved and the relocated block is
+// updated to point to the new location. A block referred to directly by its
+// handle is moved by making it a relocated block. A relocated block cannot be
+// moved, its location is its handle, so Compact cannot shrink the file below
+// the last block referred to directly by its handle. Use CompactRehandle to
+// get past that limit.
+//
+// If no free block is big enough for the last block of the file, Compact
+// slides the used blocks following the first free block towards the file
+// start, which collects the free space in one free block, until the last block
+// fits in it. Only blocks which can be moved without leaving a relocated block
+// behind, the targets of relocated blocks, are slid. A Compact that runs out of
+// budget while sliding may not reduce the file size, but the next one
+// continues from where it stopped.
+//
+// Compact stops when the last block of the file cannot be moved, when moving
+// the next block would make the total size of the moved blocks exceed budget
+// bytes or when ctx is done. A negative budget means no limit.
+//
+// Every block is moved within its own BeginUpdate/EndUpdate pair, so the
+// Filer is structurally consistent whenever Compact returns. To find the
+// relocated blocks and the block boundaries, Compact reads the headers of all
+// blocks first. Compact holds the Allocator exclusively for the whole time,
+// so it excludes Get as well, use budget to limit that time.
+//
+// Compact returns the number of bytes by which the file size was reduced.
+func (a *Allocator) Compact(ctx context.Context, budget int64) (reclaimed int64, err error) {
+	reclaimed, _, err = a.compact(ctx, budget, nil)
+	return
+}
+
+// CompactRehandle is like Compact, but it can also give blocks new handles,
+// if the client is able to replace the copies of the old handles it keeps,
+// for example in other blocks. That lets it reclaim nearly all of the free
+// space. CompactRehandle asks movable whether that's the case for a handle,
+// without any generation, before it moves its block. If movable returns true,
+// the block is moved without leaving a relocated block behind and a relocated
+// block is removed, its target becomes the block of the handle. The blocks for
+// which movable returns false are handled as by Compact.
+//
+// The new handles are returned in moved, keyed by the old ones, both without
+// generations, also when CompactRehandle fails. A moved block keeps its
+// generation. The old handles are invalid and the client must replace them by
+// the new ones before using them again, see for example BTree.Rehandle. To
+// make CompactRehandle and the replacement a single transaction, enclose them
+// in BeginUpdate/EndUpdate of the Allocator's Filer.
+//
+// CompactRehandle slides also the blocks it can give new handles. Removing a
+// relocated block counts as moving it.
+func (a *Allocator) CompactRehandle(ctx context.Context, budget int64, movable func(handle int64) bool) (reclaimed int64, moved map[int64]int64, err error) {
+	if movable == nil {
+		movable = func(int64) bool { return false }
+	}
+	return a.compact(ctx, budget, movable)
+}
+
+func (a *Allocator) compact(ctx context.Context, budget int64, movable func(handle int64) bool) (reclaimed int64, moved map[int64]int64, err error) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	sz0, err := a.f.Size()
+	if err != nil {
+		return
+	}
+
+	c := &compactor{a: a, gap: -1, movable: movable, relocs: map[int64]int64{}}
+	for h, i := int64(1), 0; h2off(h) < sz0; i++ {
+		if i%1024 == 0 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+
+		tag, s, _, n, err := a.nfo(h)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch tag {
+		case tagFreeShort, tagFreeLong:
+			// nop
+		case tagUsedRelocated:
+			c.relocs[n] = h
+			fallthrough
+		default:
+			c.blocks = append(c.blocks, cblock{h, s})
+		}
+		h += s
+	}
+
+	if movable != nil {
+		moved, c.orig = map[int64]int64{}, map[int64]int64{}
+	}
+	sz := sz0
+	var total int64
+loop:
+	for len(c.blocks) != 0 {
+		i := len(c.blocks) - 1
+		if h2off(c.blocks[i].h) >= sz {
+			c.blocks = c.blocks[:i]
+			continue
+		}
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var tag byte
+		var atoms, link int64
+		if tag, atoms, _, link, err = a.nfo(c.blocks[i].h); err != nil {
+			break
+		}
+
+		if tag == tagFreeShort || tag == tagFreeLong {
+			err = &ErrILSEQ{Type: ErrExpUsedTag, Off: h2off(c.blocks[i].h), Arg: int64(tag)}
+			break
+		}
+
+		h := c.blocks[i].h
+		orig, rehandle := c.canRehandle(h)
+		_, isTarget := c.relocs[h]
+		dst := -1 // A free block from the FLT.
+		switch {
+		case tag == tagUsedRelocated:
+			if !rehandle {
+				break loop
+			}
+		case !isTarget && !rehandle && atoms == 1:
+			break loop
+		case a.flt.slot(int(atoms)) != nil:
+			// nop
+		default:
+			if j := c.fit(i, atoms); j >= 0 {
+				dst = j // The free block preceding block j.
+				break
+			}
+
+			j := c.slidable()
+			if j < 0 {
+				break loop
+			}
+
+			if c.blocks[j].h-c.start(j) >= atoms {
+				dst = j // The free block preceding block j.
+				break
+			}
+
+			// Slide block j.
+			i, dst, h = j, j, c.blocks[j].h
+			if tag, atoms, _, link, err = a.nfo(h); err != nil {
+				break loop
+			}
+
+			orig, rehandle = c.canRehandle(h)
+			_, isTarget = c.relocs[h]
+		}
+
+		if budget >= 0 && total+16*atoms > budget {
+			break
+		}
+
+		newH := link
+		switch {
+		case tag == tagUsedRelocated:
+			err = a.update(func() error { return c.unrelocate(i, link) })
+		case isTarget:
+			err = a.update(func() error { return c.move(i, tag, atoms, dst) })
+		case rehandle:
+			err = a.update(func() (err error) {
+				newH, err = c.rehandle(i, tag, atoms, dst)
+				return err
+			})
+		default:
+			err = a.update(func() error { return c.relocate(i, tag, atoms, dst) })
+		}
+		if err != nil {
+			a.stats = nil
+			break
+		}
+
+		if rehandle {
+			delete(c.orig, h)
+			moved[orig] = newH
+			c.orig[newH] = orig
+		}
+		total += 16 * atoms
+		if sz, err = a.f.Size(); err != nil {
+			break
+		}
+	}
+	return sz0 - sz, moved, err
+}
+
+// update performs f within its own BeginUpdate/EndUpdate pair.
+func (a *Allocator) update(f func() error) (err error) {
+	if err = a.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	if err = f(); err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	return a.f.EndUpdate()
+}
+
+// cblock is a used block seen by Allocator.compact.
+type cblock struct {
+	h, atoms int64
+}
+
+// compactor holds the state of Allocator.compact.
+type compactor struct {
+	a       *Allocator
+	blocks  []cblock         // Used blocks in file order.
+	first   int              // No free blocks precede blocks[:first].
+	gap     int              // blocks index following the free block being slid or -1.
+	movable func(int64) bool // Allocator.compact's movable.
+	orig    map[int64]int64  // New handle -> old handle, of the moved blocks.
+	relocs  map[int64]int64  // Relocation target -> relocated block.
+}
+
+// canRehandle returns the original handle of block h and whether it can be
+// given a new handle.
+func (c *compactor) canRehandle(h int64) (orig int64, ok bool) {
+	orig = h
+	if o, ok := c.orig[h]; ok {
+		orig = o
+	}
+	_, isTarget := c.relocs[h]
+	return orig, !isTarget && c.movable != nil && c.movable(orig)
+}
+
+// start returns the handle following block i-1, the start of the free block
+// preceding block i, if any.
+func (c *compactor) start(i int) int64 {
+	if i == 0 {
+		return 1
+	}
+
+	b := c.blocks[i-1]
+	return b.h + b.atoms
+}
+
+// fit returns the index of the first block, preceding block i, which follows
+// a free block of at least atoms atoms, or -1. Unlike the FLT, fit finds also
+// the free blocks not at the head of their list.
+func (c *compactor) fit(i int, atoms int64) int {
+	for j := c.first; j < i; j++ {
+		if c.blocks[j].h-c.start(j) >= atoms {
+			return j
+		}
+	}
+	return -1
+}
+
+// slidable returns the index of the first block which follows a free block
+// and which can be moved without leaving a relocated block behind, or -1.
+func (c *compactor) slidable() int {
+	bl := c.blocks
+	for ; c.first < len(bl) && c.start(c.first) == bl[c.first].h; c.first++ {
+	}
+	i := c.first
+	if c.gap > i {
+		i = c.gap
+	}
+	for ; i < len(bl); i++ {
+		if c.start(i) == bl[i].h {
+			continue
+		}
+
+		_, isTarget := c.relocs[bl[i].h]
+		if _, ok := c.canRehandle(bl[i].h); isTarget || ok {
+			c.gap = i
+			return i
+		}
+	}
+	c.gap = -1
+	return -1
+}
+
+// copy copies the used block i to the free block preceding block dst or, if
+// dst is negative, to a free block from the FLT, and returns its new handle.
+// If dst == i, block i slides into the free block preceding it and copy frees
+// the rest.
+func (c *compactor) copy(i int, tag byte, atoms int64, dst int) (newH int64, err error) {
+	a := c.a
+	h := c.blocks[i].h
+	off := h2off(h)
+	dlen, doff := int(tag), off+1
+	if tag == tagUsedLong {
+		var m [2]byte
+		if err = a.read(m[:], off+1); err != nil {
+			return
+		}
+
+		dlen, doff = m2n(int(m[0])<<8|int(m[1])), off+3
+	}
+	b := bufs.GCache.Get(dlen + 1)
+	defer bufs.GCache.Put(b)
+	if err = a.read(b[:dlen], doff); err != nil {
+		return
+	}
+
+	if err = a.read(b[dlen:], off+16*atoms-1); err != nil {
+		return
+	}
+
+	if dst < 0 {
+		if newH, err = a.alloc(b[:dlen], b[dlen]); err != nil {
+			return
+		}
+
+		bl := c.blocks
+		j := sort.Search(len(bl), func(j int) bool { return bl[j].h >= newH })
+		c.insert(j, cblock{newH, atoms})
+		return
+	}
+
+	newH = c.start(dst)
+	ftag, fatoms, p, n, err := a.nfo(newH)
+	if err != nil {
+		return
+	}
+
+	if ftag != tagFreeShort && ftag != tagFreeLong {
+		return 0, &ErrILSEQ{Type: ErrExpFreeTag, Off: h2off(newH), Arg: int64(ftag)}
+	}
+
+	if err = a.unlink(newH, fatoms, p, n); err != nil {
+		return
+	}
+
+	if err = a.writeUsedBlock(newH, b[dlen], b[:dlen]); err != nil {
+		return
+	}
+
+	if dst == i {
+		c.blocks[i].h = newH
+		c.gap = i + 1
+		return newH, a.free2(newH+atoms, fatoms)
+	}
+
+	c.insert(dst, cblock{newH, atoms})
+	if rest := fatoms - atoms; rest != 0 {
+		err = a.link(newH+atoms, rest)
+	}
+	return
+}
+
+// insert inserts b into c.blocks at index i.
+func (c *compactor) insert(i int, b cblock) {
+	bl := append(c.blocks, cblock{})
+	copy(bl[i+1:], bl[i:])
+	bl[i] = b
+	c.blocks = bl
+	if c.gap >= i {
+		c.gap++
+	}
+}
+
+// move moves the used block i, the target of a relocated block, and updates
+// the relocated block.
+func (c *compactor) move(i int, tag byte, atoms int64, dst int) (err error) {
+	h := c.blocks[i].h
+	stub := c.relocs[h]
+	newH, err := c.copy(i, tag, atoms, dst)
+	if err != nil {
+		return
+	}
+
+	rb := bufs.GCache.Cget(7)
+	defer bufs.GCache.Put(rb)
+	if err = c.a.writeAt(h2b(rb, newH), h2off(stub)+1); err != nil {
+		return
+	}
+
+	delete(c.relocs, h)
+	c.relocs[newH] = stub
+	if dst == i {
+		return
+	}
+
+	return c.a.free2(h, atoms)
+}
+
+// relocate moves the used block i, referred to directly by its handle, and
+// makes it a relocated block.
+func (c *compactor) relocate(i int, tag byte, atoms int64, dst int) (err error) {
+	a := c.a
+	h := c.blocks[i].h
+	newH, err := c.copy(i, tag, atoms, dst)
+	if err != nil {
+		return
+	}
+
+	rb := bufs.GCache.Cget(16)
+	defer bufs.GCache.Put(rb)
+	rb[0] = tagUsedRelocated
+	h2b(rb[1:], newH)
+	if err = a.writeAt(rb, h2off(h)); err != nil {
+		return
+	}
+
+	if err = a.free2(h+1, atoms-1); err != nil {
+		return
+	}
+
+	// copy may have inserted newH before h.
+	bl := c.blocks
+	bl[sort.Search(len(bl), func(j int) bool { return bl[j].h >= h })].atoms = 1
+	c.relocs[newH] = h
+	if st := a.stats; st != nil {
+		st.AllocAtoms++
+		st.Relocations++
+	}
+	return
+}
+
+// rehandle moves the used block i, referred to directly by its handle, and
+// returns its new handle.
+func (c *compactor) rehandle(i int, tag byte, atoms int64, dst int) (newH int64, err error) {
+	h := c.blocks[i].h
+	if newH, err = c.copy(i, tag, atoms, dst); err != nil {
+		return
+	}
+
+	c.a.cfree(h)
+	if dst == i {
+		return
+	}
+
+	return newH, c.a.free2(h, atoms)
+}
+
+// unrelocate removes the relocated block i targeting target, which becomes
+// the block of its own handle.
+func (c *compactor) unrelocate(i int, target int64) (err error) {
+	a := c.a
+	h := c.blocks[i].h
+	a.cfree(h)
+	if err = a.free2(h, 1); err != nil {
+		return
+	}
+
+	c.blocks = append(c.blocks[:i], c.blocks[i+1:]...)
+	if c.gap > i {
+		c.gap--
+	}
+	delete(c.relocs, target)
+	if st := a.stats; st != nil {
+		st.AllocAtoms--
+		st.Relocations--
+	}
+	return
+}
+
+// Repair rebuilds the free space bookkeeping of the Allocator's Filer. It
+// scans all blocks sequentially, joins adjacent free blocks, discards free
+// blocks at the end of the file and then rebuilds the FLT and all the free
+// lists from scratch. Used blocks, and thus handles and their content, are
+// left untouched. After Repair succeeds, problems reported by Verify as
+// ErrAdjacentFree, ErrFLT, ErrFLTSize, ErrFreeChaining, ErrFreeTailBlock,
+// ErrHead, ErrLongFreeNextBeyondEOF, ErrLongFreePrevBeyondEOF,
+// ErrLostFreeBlock or ErrShortFreeTailTag are fixed.
+//
+// The sequential scan relies on the block sizes. If a used block spans beyond
+// the end of the file, or if the head and tail of a long free block do not
+// agree on its size, the block boundaries cannot be reliably determined. Such
+// a problem is reported to log and Repair returns an error without modifying
+// the file. Passing a nil log works like providing a log function always
+// returning false. Non-structural errors, like for instance Filer read errors,
+// are returned without being reported to log.
+//
+// The rebuilding is performed within a single BeginUpdate/EndUpdate pair.
+func (a *Allocator) Repair(log func(error) bool) (err error) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	if log == nil {
+		log = nolog
+	}
+
+	fsz, err := a.f.Size()
+	if err != nil {
+		return
+	}
+
+	if fsz%16 != 0 {
+		err = &ErrILSEQ{Type: ErrFileSize, Name: a.f.Name(), Arg: fsz}
+		log(err)
+		return
+	}
+
+	var free [][2]int64 // {handle, atoms} of the joined free blocks.
+	totalAtoms := (fsz - fltSz) / atomLen
+	var b [22]byte
+	for h, atoms := int64(1), int64(0); h <= totalAtoms; h += atoms {
+		var tag byte
+		if tag, atoms, _, _, err = a.nfo(h); err != nil {
+			return
+		}
+
+		off := h2off(h)
+		switch tag {
+		default: // Used
+			if h+atoms-1 > totalAtoms {
+				err = &ErrILSEQ{Type: ErrVerifyUsedSpan, Off: off, Arg: atoms}
+				log(err)
+				return
+			}
+
+			continue
+		case tagFreeShort:
+			// nop
+		case tagFreeLong:
+			if atoms < 2 {
+				err = &ErrILSEQ{Type: ErrLongFreeBlkTooShort, Off: off, Arg: atoms}
+				log(err)
+				return
+			}
+
+			if h+atoms-1 > totalAtoms {
+				err = &ErrILSEQ{Type: ErrLongFreeBlkTooLong, Off: off, Arg: atoms}
+				log(err)
+				return
+			}
+
+			if err = a.read(b[:8], h2off(h+atoms)-8); err != nil {
+				return
+			}
+
+			if b[7] != tagFreeLong {
+				err = &ErrILSEQ{Type: ErrLongFreeTailTag, Off: off, Arg: int64(b[7])}
+				log(err)
+				return
+			}
+
+			if s2 := b2h(b[:]); s2 != atoms {
+				err = &ErrILSEQ{Type: ErrVerifyTailSize, Off: off, Arg: atoms, Arg2: s2}
+				log(err)
+				return
+			}
+		}
+
+		if n := len(free); n != 0 && free[n-1][0]+free[n-1][1] == h {
+			free[n-1][1] += atoms
+			continue
+		}
+
+		free = append(free, [2]int64{h, atoms})
+	}
+
+	if err = a.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	if err = a.repair(free, totalAtoms); err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	return a.f.EndUpdate()
+}
+
+func (a *Allocator) repair(free [][2]int64, totalAtoms int64) (err error) {
+	var b [fltSz]byte
+	if err = a.writeAt(b[:], 0); err != nil {
+		return
+	}
+
+	a.flt.init()
+	for _, v := range free {
+		h, atoms := v[0], v[1]
+		if h+atoms-1 == totalAtoms { // Free tail block.
+			return a.f.Truncate(h2off(h))
+		}
+
+		if err = a.link(h, atoms); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Walk calls f for every handle of a used block, in the order of the blocks
+// in the file. Size is the length of the stored content, ie. the compressed
+// length if compressed is true. Relocated reports whether the handle refers
+// to a relocated block, in which case size and compressed describe the
+// relocation target. Relocation targets themselves are not reported as they
+// are not valid handles. Walk stops and returns the error if f returns a non
+// nil error.
+//
+// To find the relocation targets, Walk reads the headers of all blocks twice.
+// Walk does not read the content of any block. In the handle generations mode
+// the handles passed to f thus include no generation.
+//
+// The Allocator must not be mutated while Walk is in progress.
+func (a *Allocator) Walk(f func(handle int64, size int, compressed, relocated bool) error) (err error) {
+	targets := map[int64]bool{}
+	if err = a.walk(func(h int64, tag byte, atoms, link int64) error {
+		if tag == tagUsedRelocated {
+			targets[link] = true
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	return a.walk(func(h int64, tag byte, atoms, link int64) error {
+		relocated := tag == tagUsedRelocated
+		switch {
+		case relocated:
+			// nop
+		case targets[h]:
+			return nil
+		default:
+			link = h
+		}
+		dlen, cc, err := a.usedNfo(link, h)
+		if err != nil {
+			return err
+		}
+
+		return f(h, dlen, cc != tagNotCompressed, relocated)
+	})
+}
+
+// walk calls f for every used block. Link is the relocation target of
+// relocated blocks.
+func (a *Allocator) walk(f func(h int64, tag byte, atoms, link int64) error) (err error) {
+	sz, err := a.f.Size()
+	if err != nil {
+		return
+	}
+
+	var tag byte
+	for h, atoms, link := int64(1), int64(0), int64(0); h2off(h) < sz; h += atoms {
+		if tag, atoms, _, link, err = a.nfo(h); err != nil {
+			return
+		}
+
+		switch tag {
+		case tagFreeShort, tagFreeLong:
+			// nop
+		default:
+			if err = f(h, tag, atoms, link); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// usedNfo returns the length of the stored content and the CC tail tag of the
+// used block h. From is the relocated block referring to h, if any.
+func (a *Allocator) usedNfo(h, from int64) (dlen int, cc byte, err error) {
+	var b [3]byte
+	off := h2off(h)
+	if err = a.read(b[:], off); err != nil {
+		return
+	}
+
+	switch tag := b[0]; tag {
+	case tagUsedLong:
+		dlen = m2n(int(b[1])<<8 | int(b[2]))
+	case tagUsedRelocated, tagFreeShort, tagFreeLong:
+		return 0, 0, &ErrILSEQ{Type: ErrInvalidRelocTarget, Off: h2off(from), Arg: h}
+	default:
+		dlen = int(tag)
+	}
+
+	if err = a.read(b[:1], off+16*int64(n2atoms(dlen))-1); err != nil {
+		return
+	}
+
+	return dlen, b[0], nil
+}
+
+// Stats returns the number of handles, the number of compressed blocks, the
+// total, allocated and free atoms and the number of relocated blocks of the
+// Allocator's Filer. The AllocBytes, AllocMap and FreeMap fields are not
+// set, only Verify computes them.
+//
+// The first call of Stats reads the headers of all blocks. The Allocator then
+// maintains the statistics incrementally and Stats takes only O(1) time. The
+// statistics are collected again when a transaction is rolled back or when an
+// Allocator method fails.
+//
+// Stats is safe for concurrent use by multiple goroutines. It excludes Get
+// while it runs.
+func (a *Allocator) Stats() (st AllocStats, err error) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	sz, err := a.f.Size()
+	if err != nil {
+		return
+	}
+
+	if a.stats == nil {
+		var s AllocStats
+		if err = a.walk(func(h int64, tag byte, atoms, link int64) error {
+			s.AllocAtoms += atoms
+			if tag == tagUsedRelocated {
+				s.Relocations++
+				return nil
+			}
+
+			s.Handles++
+			_, cc, err := a.usedNfo(h, 0)
+			if cc != tagNotCompressed {
+				s.Compression++
+			}
+			return err
+		}); err != nil {
+			return
+		}
+
+		a.stats = &s
+	}
+
+	st = *a.stats
+	if sz != 0 {
+		st.TotalAtoms = (sz - fltSz) / atomLen
+	}
+	st.FreeAtoms = st.TotalAtoms - st.AllocAtoms
+	return
+}
+
+// account adds, if sign is 1, or subtracts, if sign is -1, the atoms, the
+// relocated block and the compressed block of handle to/from the statistics
+// maintained for Stats, if any.
+func (a *Allocator) account(handle, sign int64) (err error) {
+	st := a.stats
+	if st == nil {
+		return
+	}
+
+	tag, atoms, _, link, err := a.nfo(handle)
+	if err != nil {
+		a.stats = nil
+		return
+	}
+
+	h := handle
+	if tag == tagUsedRelocated {
+		st.Relocations += sign
+		st.AllocAtoms += sign
+		h = link
+		if _, atoms, _, _, err = a.nfo(h); err != nil {
+			a.stats = nil
+			return
+		}
+	}
+
+	_, cc, err := a.usedNfo(h, handle)
+	if err != nil {
+		a.stats = nil
+		return
+	}
+
+	if cc != tagNotCompressed {
+		st.Compression += sign
+	}
+	st.Handles += sign
+	st.AllocAtoms += sign * atoms
+	return
+}
+
 func (a *Allocator) verifyUnused(h, totalAtoms int64, tag byte, log func(error) bool, fast bool) (atoms, prev, next int64, err error) {
 	switch tag {
 	default:
@@ -1297,16 +2395,18 @@ func (a *Allocator) verifyUsed(h, totalAtoms int64, tag byte, buf, ubuf []byte,
 		return
 	}
 
-	var cc byte
-	switch cc = tailBuf[padding]; cc {
+	var c Codec
+	switch cc := tailBuf[padding]; cc {
 	default:
-		err = &ErrILSEQ{Type: ErrTailTag, Off: h2off(h)}
-		log(err)
-		return
-	case tagCompressed:
+		if c = codec(cc); c == nil {
+			err = &ErrILSEQ{Type: ErrTailTag, Off: h2off(h), Arg: int64(cc)}
+			log(err)
+			return
+		}
+
 		compressed = true
 		if tag == tagUsedRelocated {
-			err = &ErrILSEQ{Type: ErrTailTag, Off: h2off(h)}
+			err = &ErrILSEQ{Type: ErrTailTag, Off: h2off(h), Arg: int64(cc)}
 			log(err)
 			return
 		}
@@ -1318,8 +2418,8 @@ func (a *Allocator) verifyUsed(h, totalAtoms int64, tag byte, buf, ubuf []byte,
 		}
 	}
 
-	if cc == tagCompressed {
-		if ubuf, err = zappy.Decode(ubuf, buf[:dlen]); err != nil || len(ubuf) > maxRq {
+	if c != nil {
+		if ubuf, err = c.Decode(ubuf, buf[:dlen]); err != nil || len(ubuf) > maxRq {
 			err = &ErrILSEQ{Type: ErrDecompress, Off: h2off(h)}
 			log(err)
 			return
@@ -1720,24 +2820,33 @@ func (f *flt) load(fi Filer, off int64) (err error) {
 }
 
 func (f *flt) find(rq int) (h int64) {
+	if p := f.slot(rq); p != nil {
+		h, p.head = p.head, 0
+	}
+	return
+}
+
+// slot returns the slot of the free list find(rq) takes its result from or
+// nil if find(rq) would return 0.
+func (f *flt) slot(rq int) *fltSlot {
 	switch {
 	case rq < 1:
 		panic(rq)
 	case rq >= maxFLTRq:
-		h, f[13].head = f[13].head, 0
-		return
+		if f[13].head == 0 {
+			return nil
+		}
+
+		return &f[13]
 	default:
 		g := f[mathutil.Log2Uint16(uint16(rq)):]
 		for i := range g {
 			p := &g[i]
-			if rq <= int(p.minSize) {
-				if h = p.head; h != 0 {
-					p.head = 0
-					return
-				}
+			if rq <= int(p.minSize) && p.head != 0 {
+				return p
 			}
 		}
-		return
+		return nil
 	}
 }
 
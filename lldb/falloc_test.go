@@ -6,7 +6,9 @@ package lldb
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -14,6 +16,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -1831,3 +1834,887 @@ func TestFltHead(t *testing.T) {
 	}
 
 }
+
+func TestAllocatorCompact(t *testing.T) {
+	const N = 2000
+
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Compress = true
+	rng := rand.New(rand.NewSource(42))
+	ref := map[int64][]byte{}
+	var hs []int64
+	for i := 0; i < N; i++ {
+		b := rndBytes(rng, rng.Intn(3*maxShort))
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+		hs = append(hs, h)
+	}
+
+	// Create relocations.
+	for i := 0; i < N/4; i++ {
+		h := hs[rng.Intn(len(hs))]
+		b := rndBytes(rng, len(ref[h])+rng.Intn(5*maxShort))
+		if err = a.Realloc(h, b); err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+
+	for i, h := range hs {
+		if i%3 != 0 {
+			if err = a.Free(h); err != nil {
+				t.Fatal(err)
+			}
+
+			delete(ref, h)
+		}
+	}
+
+	check := func() {
+		// Check using a new Allocator to bypass the cache.
+		a, err := NewAllocator(f, &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for h, e := range ref {
+			g, err := a.Get(nil, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(g, e) {
+				t.Fatalf("handle %d: data mismatch", h)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = a.Compact(ctx, -1); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st AllocStats
+	if err = a.Verify(NewMemFiler(), nil, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	free := 16 * st.FreeAtoms
+	if n, err := a.Compact(context.Background(), 0); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	// Compact keeps the handles, so it cannot shrink the file below the last
+	// handle, which is or becomes a relocated block.
+	var last int64
+	for h := range ref {
+		if h > last {
+			last = h
+		}
+	}
+	limit := h2off(last) + 16
+	n, err := a.Compact(context.Background(), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("size %d -> %d, limit %d, free %d", sz0, sz, limit, free)
+	if sz != sz0-n || sz < limit {
+		t.Fatal(n, sz0, sz)
+	}
+
+	if g, e := n, 3*(sz0-limit)/4; g < e {
+		t.Fatalf("reclaimed %d of %d bytes above the last handle", g, sz0-limit)
+	}
+
+	if n, err := a.Compact(context.Background(), -1); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	check()
+
+	movable := func(h int64) bool {
+		if _, ok := ref[h]; !ok {
+			t.Fatalf("movable(%d): not a handle", h)
+		}
+
+		return true
+	}
+	update := func(moved map[int64]int64) {
+		m := map[int64][]byte{}
+		for h, b := range ref {
+			if newH, ok := moved[h]; ok {
+				h = newH
+			}
+			m[h] = b
+		}
+		ref = m
+	}
+
+	// With movable, the relocated blocks are removed and the file shrinks
+	// further, call after call.
+	var calls int
+	for i := 0; i < 100; i++ {
+		n, moved, err := a.CompactRehandle(context.Background(), sz/10, movable)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		update(moved)
+		if n != 0 {
+			calls++
+		}
+	}
+	check()
+	if calls < 2 {
+		t.Fatal(calls)
+	}
+
+	if sz, err = f.Size(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("size %d -> %d in %d calls", sz0-n, sz, calls)
+	if g, e := sz0-sz, 9*free/10; g < e {
+		t.Fatalf("reclaimed %d of %d free bytes", g, free)
+	}
+
+	if n, moved, err := a.CompactRehandle(context.Background(), -1, movable); n != 0 || len(moved) != 0 || err != nil {
+		t.Fatal(n, moved, err)
+	}
+}
+
+func TestAllocatorOptions(t *testing.T) {
+	if _, err := NewAllocator(NewMemFiler(), &Options{Compression: 42}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	a, err := NewAllocator(NewMemFiler(), &Options{Compression: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Compress {
+		t.Fatal(a.Compress)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	cache := func(opts *Options) (buffers int, bytes int64) {
+		a, err := NewAllocator(NewMemFiler(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var hs []int64
+		for i := 0; i < 1000; i++ {
+			h, err := a.Alloc(rndBytes(rng, 1+rng.Intn(2*maxShort)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hs = append(hs, h)
+		}
+		for i := 0; i < 10000; i++ {
+			if _, err := a.Get(nil, hs[rng.Intn(len(hs))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = cacheAudit(a.m, &a.lru); err != nil {
+			t.Fatal(err)
+		}
+
+		buffers, _, _, _, _, _ = a.CacheStats()
+		return buffers, a.lruBytes
+	}
+
+	if n, _ := cache(&Options{CacheSize: -1}); n != 0 {
+		t.Fatal(n)
+	}
+
+	if n, _ := cache(&Options{CacheSize: 7}); n != 7 {
+		t.Fatal(n)
+	}
+
+	if n, _ := cache(&Options{}); n <= 10 || n > 500 {
+		t.Fatal(n)
+	}
+
+	if n, sz := cache(&Options{CacheBytes: 1000}); n == 0 || sz > 1000 {
+		t.Fatal(n, sz)
+	}
+
+	secret := bytes.Repeat([]byte("secret "), 1000)
+	wipe := func(opts *Options) bool {
+		f := NewMemFiler()
+		a, err := NewAllocator(f, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			h, err := a.Alloc(secret[:100*(i+1)])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = a.Alloc([]byte("keep")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = a.Free(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		return bytes.Contains(filerBytes(f), []byte("secret"))
+	}
+
+	if !wipe(&Options{}) {
+		t.Fatal("expected leaked content")
+	}
+
+	if wipe(&Options{WipeOnFree: true}) {
+		t.Fatal("leaked content")
+	}
+}
+
+func TestAllocatorRepair(t *testing.T) {
+	const N = 1000
+
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	ref := map[int64][]byte{}
+	var hs []int64
+	for i := 0; i < N; i++ {
+		b := rndBytes(rng, rng.Intn(2*maxShort))
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+		hs = append(hs, h)
+	}
+
+	for i := 0; i < N/4; i++ {
+		h := hs[rng.Intn(len(hs))]
+		b := rndBytes(rng, len(ref[h])+rng.Intn(3*maxShort))
+		if err = a.Realloc(h, b); err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+
+	for i, h := range hs {
+		if i%3 == 0 {
+			if err = a.Free(h); err != nil {
+				t.Fatal(err)
+			}
+
+			delete(ref, h)
+		}
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the free space bookkeeping: Turn some used blocks, incl. the
+	// last one, into free blocks not on any list, break the links of some
+	// free blocks and zero the FLT.
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	var free []int64
+	for h, atoms := int64(1), int64(0); h2off(h) < sz; h += atoms {
+		var tag byte
+		if tag, atoms, _, _, err = a.nfo(h); err != nil {
+			t.Fatal(err)
+		}
+
+		switch tag {
+		case tagFreeShort, tagFreeLong:
+			free = append(free, h)
+		default:
+			last = h
+		}
+	}
+
+	for h := range ref {
+		if h%7 != 0 && h != last {
+			continue
+		}
+
+		tag, atoms, _, _, err := a.nfo(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tag == tagUsedRelocated {
+			continue
+		}
+
+		if err = a.makeFree(h, atoms, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		delete(ref, h)
+	}
+
+	for i, h := range free {
+		if i%2 != 0 {
+			continue
+		}
+
+		tag, _, _, _, err := a.nfo(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		off := h2off(h) + 1 // P
+		if tag == tagFreeLong {
+			off += 7
+		}
+		if _, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 42}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = f.WriteAt(make([]byte, fltSz), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = a.Repair(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for h, e := range ref {
+		g, err := a.Get(nil, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(g, e) {
+			t.Fatalf("handle %d: data mismatch", h)
+		}
+	}
+
+	// The rebuilt free lists are usable.
+	for i := 0; i < N; i++ {
+		if _, err = a.Alloc(rndBytes(rng, rng.Intn(2*maxShort))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged size of a free block cannot be repaired.
+	for h, atoms := int64(1), int64(0); ; h += atoms {
+		var tag byte
+		if tag, atoms, _, _, err = a.nfo(h); err != nil {
+			t.Fatal(err)
+		}
+
+		if tag == tagFreeLong {
+			if _, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 1}, h2off(h)+1); err != nil {
+				t.Fatal(err)
+			}
+
+			break
+		}
+	}
+
+	g0 := filerBytes(f)
+	var e error
+	if err = a.Repair(func(err error) bool { e = err; return false }); err == nil || err != e {
+		t.Fatal(err, e)
+	}
+
+	if g := filerBytes(f); !bytes.Equal(g, g0) {
+		t.Fatal("file modified")
+	}
+}
+
+func TestAllocatorWalk(t *testing.T) {
+	const N = 1000
+
+	a, err := NewAllocator(NewMemFiler(), &Options{Compression: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	ref := map[int64][]byte{}
+	var hs []int64
+	for i := 0; i < N; i++ {
+		b := rndBytes(rng, rng.Intn(3*maxShort))
+		if i%2 == 0 {
+			b = bytes.Repeat([]byte{byte(i)}, len(b))
+		}
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+		hs = append(hs, h)
+	}
+
+	for i := 0; i < N/4; i++ {
+		h := hs[rng.Intn(len(hs))]
+		b := rndBytes(rng, len(ref[h])+rng.Intn(3*maxShort))
+		if err = a.Realloc(h, b); err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+
+	for i, h := range hs {
+		if i%3 == 0 {
+			if err = a.Free(h); err != nil {
+				t.Fatal(err)
+			}
+
+			delete(ref, h)
+		}
+	}
+
+	var st AllocStats
+	if err = a.Verify(NewMemFiler(), nil, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[int64]bool{}
+	var compressed, relocated int64
+	last := int64(-1)
+	if err = a.Walk(func(h int64, size int, c, r bool) error {
+		if h <= last {
+			t.Fatal(h, last)
+		}
+
+		last = h
+		b, ok := ref[h]
+		if !ok {
+			t.Fatalf("invalid handle %d", h)
+		}
+
+		if c {
+			compressed++
+		}
+		if r {
+			relocated++
+		}
+		if c && size >= len(b) || !c && size != len(b) {
+			t.Fatal(h, size, len(b), c)
+		}
+
+		seen[h] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := len(seen), len(ref); g != e {
+		t.Fatal(g, e)
+	}
+
+	if compressed != st.Compression || relocated != st.Relocations || relocated == 0 {
+		t.Fatal(compressed, st.Compression, relocated, st.Relocations)
+	}
+
+	e := errors.New("stop")
+	n := 0
+	if err = a.Walk(func(int64, int, bool, bool) error { n++; return e }); err != e || n != 1 {
+		t.Fatal(err, n)
+	}
+}
+
+func TestAllocatorStats(t *testing.T) {
+	const N = 1000
+
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{Compression: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		g, err := a.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e AllocStats
+		if err = a.Verify(NewMemFiler(), nil, &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if g.Handles != e.Handles ||
+			g.Compression != e.Compression ||
+			g.TotalAtoms != e.TotalAtoms ||
+			g.AllocAtoms != e.AllocAtoms ||
+			g.Relocations != e.Relocations ||
+			g.FreeAtoms != e.FreeAtoms {
+			t.Fatalf("\n%+v\n%+v", g, e)
+		}
+	}
+
+	check()
+	rng := rand.New(rand.NewSource(42))
+	content := func() []byte {
+		b := rndBytes(rng, rng.Intn(3*maxShort))
+		if rng.Intn(2) == 0 {
+			b = bytes.Repeat(b[:len(b)/10], 10)
+		}
+		return b
+	}
+
+	var hs []int64
+	for i := 0; i < N; i++ {
+		switch x := rng.Intn(10); {
+		case x < 5 || len(hs) == 0:
+			h, err := a.Alloc(content())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hs = append(hs, h)
+		case x < 8:
+			if err = a.Realloc(hs[rng.Intn(len(hs))], content()); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			j := rng.Intn(len(hs))
+			if err = a.Free(hs[j]); err != nil {
+				t.Fatal(err)
+			}
+
+			hs = append(hs[:j], hs[j+1:]...)
+		}
+		if i%100 == 0 {
+			check()
+		}
+	}
+	check()
+
+	if _, err = a.Compact(context.Background(), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+	for _, h := range hs {
+		if err = a.Free(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+}
+
+func TestAllocatorConcurrentGet(t *testing.T) {
+	const (
+		N       = 100 // Stable blocks.
+		readers = 8
+		rounds  = 200
+	)
+
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(r, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	ref := map[int64][]byte{}
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i++ {
+		b := rndBytes(rng, rng.Intn(3*maxShort))
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var buf []byte
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				for h, e := range ref {
+					g, err := a.Get(buf, h)
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					if !bytes.Equal(g, e) {
+						errs <- fmt.Errorf("handle %d: data mismatch", h)
+						return
+					}
+
+					buf = g
+				}
+			}
+		}()
+	}
+
+	// The writer allocates, reallocates and frees other blocks, rolling
+	// back every third transaction.
+	var hs []int64
+	for i := 0; i < rounds; i++ {
+		if err = r.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case len(hs) != 0 && rng.Intn(3) == 0:
+			j := rng.Intn(len(hs))
+			if err = a.Free(hs[j]); err != nil {
+				t.Fatal(err)
+			}
+
+			hs = append(hs[:j], hs[j+1:]...)
+		case len(hs) != 0 && rng.Intn(2) == 0:
+			if err = a.Realloc(hs[rng.Intn(len(hs))], rndBytes(rng, rng.Intn(3*maxShort))); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			h, err := a.Alloc(rndBytes(rng, rng.Intn(3*maxShort)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hs = append(hs, h)
+		}
+		if i%3 == 0 {
+			if err = r.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Recreate hs from the rolled back state.
+			hs = hs[:0]
+			if err = a.Walk(func(h int64, _ int, _, _ bool) error {
+				if _, ok := ref[h]; !ok {
+					hs = append(hs, h)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		if err = r.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocatorGenerations(t *testing.T) {
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{Generations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h int64, e string) {
+		b, err := a.Get(nil, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := string(b); g != e {
+			t.Fatalf("%q %q", g, e)
+		}
+	}
+
+	h1, err := a.Alloc([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h1&maxHandle != 1 || h1>>genShift == 0 {
+		t.Fatalf("%#x", h1)
+	}
+
+	get(h1, "foo")
+	get(h1&maxHandle, "foo") // Not checked.
+	if err = a.Free(h1); err != nil {
+		t.Fatal(err)
+	}
+
+	isGenErr := func(err error, gen byte) {
+		if e, ok := err.(*ErrGeneration); !ok || e.Gen != gen {
+			t.Fatalf("%T(%v), expected *ErrGeneration with block generation %d", err, err, gen)
+		}
+	}
+
+	_, err = a.Get(nil, h1)
+	isGenErr(err, 0)
+	h2, err := a.Alloc([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h2&maxHandle != h1&maxHandle || h2 == h1 {
+		t.Fatalf("%#x %#x", h1, h2)
+	}
+
+	gen2 := byte(h2 >> genShift)
+	_, err = a.Get(nil, h1)
+	isGenErr(err, gen2)
+	isGenErr(a.Realloc(h1, []byte("baz")), gen2)
+	isGenErr(a.Free(h1), gen2)
+	get(h2, "bar")
+
+	// Realloc keeps the generation, also when the handle is not checked.
+	big := string(bytes.Repeat([]byte("x"), 1000))
+	if err = a.Realloc(h2, []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+
+	get(h2, big)
+	if err = a.Realloc(h2&maxHandle, []byte("qux")); err != nil {
+		t.Fatal(err)
+	}
+
+	get(h2, "qux")
+
+	// BTrees store handles in 7 bytes, ie. without generations.
+	bt, bh, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err = bt.Set([]byte(fmt.Sprint(i)), bytes.Repeat([]byte{byte(i)}, 10*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bt, err = OpenBTree(a, nil, bh); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		v, err := bt.Get(nil, []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(v, bytes.Repeat([]byte{byte(i)}, 10*i)) {
+			t.Fatal(i)
+		}
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handles with generations are out of limits if the mode is not
+	// enabled.
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Get(nil, h2); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, ok := err.(*ErrINVAL); !ok {
+		t.Fatalf("%T(%v)", err, err)
+	}
+}
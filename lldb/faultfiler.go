@@ -0,0 +1,171 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Filer injecting faults for testing error handling.
+
+package lldb
+
+import (
+	"os"
+	"syscall"
+)
+
+var _ Filer = &FaultFiler{} // Ensure FaultFiler is a Filer.
+
+// FaultFiler is a Filer wrapping another Filer and injecting faults into the
+// WriteAt, Sync and Truncate calls as scripted by its exported fields. It is
+// intended for testing how code using a Filer handles failing storage.
+//
+// The calls of every kind are counted from 1. A field set to N > 0 selects the
+// N-th call of the respective kind, zero disables the fault. Faults are
+// reported using Err, or, if Err is nil, as an *os.PathError wrapping EIO, ie.
+// like a failing disk would report them.
+//
+// Example, fail the third write and all writes, syncs and truncations after
+// it:
+//
+//	f := lldb.NewFaultFiler(lldb.NewMemFiler())
+//	f.FailWriteAt = 3
+//	f.Sticky = true
+//
+// FaultFiler implements BeginUpdate, EndUpdate and Rollback by invoking them
+// on the wrapped Filer.
+type FaultFiler struct {
+	f Filer
+
+	// FailWriteAt selects the WriteAt call which fails without writing
+	// anything.
+	FailWriteAt int
+
+	// ShortWriteAt selects the WriteAt call which writes only the first
+	// half of the data and then fails.
+	ShortWriteAt int
+
+	// CorruptWriteAt selects the WriteAt call which inverts the bits of
+	// the middle byte of the data before writing it and reports success.
+	// The caller's buffer is not modified.
+	CorruptWriteAt int
+
+	// FailSync selects the Sync call which fails.
+	FailSync int
+
+	// FailTruncate selects the Truncate call which fails without
+	// truncating.
+	FailTruncate int
+
+	// If Sticky is set then after a fault was injected, all subsequent
+	// WriteAt, Sync and Truncate calls fail as well. Corrupting a write
+	// is not a fault in this sense.
+	Sticky bool
+
+	// Err, if not nil, is the error returned by the injected faults.
+	Err error
+
+	// Counters of the WriteAt, Sync and Truncate calls seen so far.
+	WriteAts, Syncs, Truncates int
+
+	// Faults counts the injected faults, including the sticky ones.
+	Faults int
+}
+
+// NewFaultFiler returns a new FaultFiler wrapping f. No faults are injected
+// until the exported fields of the result are set.
+func NewFaultFiler(f Filer) *FaultFiler {
+	return &FaultFiler{f: f}
+}
+
+func (f *FaultFiler) fault(op string) error {
+	f.Faults++
+	if err := f.Err; err != nil {
+		return err
+	}
+
+	return &os.PathError{Op: op, Path: f.Name(), Err: syscall.EIO}
+}
+
+// failing returns whether the call number n, selected by sel, fails.
+func (f *FaultFiler) failing(n, sel int) bool {
+	return n == sel || f.Sticky && f.Faults != 0
+}
+
+// BeginUpdate implements Filer.
+func (f *FaultFiler) BeginUpdate() error {
+	return f.f.BeginUpdate()
+}
+
+// Close implements Filer.
+func (f *FaultFiler) Close() error {
+	return f.f.Close()
+}
+
+// EndUpdate implements Filer.
+func (f *FaultFiler) EndUpdate() error {
+	return f.f.EndUpdate()
+}
+
+// Name implements Filer.
+func (f *FaultFiler) Name() string {
+	return f.f.Name()
+}
+
+// PunchHole implements Filer.
+func (f *FaultFiler) PunchHole(off, size int64) error {
+	return f.f.PunchHole(off, size)
+}
+
+// ReadAt implements Filer.
+func (f *FaultFiler) ReadAt(b []byte, off int64) (int, error) {
+	return f.f.ReadAt(b, off)
+}
+
+// Rollback implements Filer.
+func (f *FaultFiler) Rollback() error {
+	return f.f.Rollback()
+}
+
+// Size implements Filer.
+func (f *FaultFiler) Size() (int64, error) {
+	return f.f.Size()
+}
+
+// Sync implements Filer.
+func (f *FaultFiler) Sync() error {
+	f.Syncs++
+	if f.failing(f.Syncs, f.FailSync) {
+		return f.fault("sync")
+	}
+
+	return f.f.Sync()
+}
+
+// Truncate implements Filer.
+func (f *FaultFiler) Truncate(size int64) error {
+	f.Truncates++
+	if f.failing(f.Truncates, f.FailTruncate) {
+		return f.fault("truncate")
+	}
+
+	return f.f.Truncate(size)
+}
+
+// WriteAt implements Filer.
+func (f *FaultFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	f.WriteAts++
+	switch {
+	case f.failing(f.WriteAts, f.FailWriteAt):
+		return 0, f.fault("write")
+	case f.WriteAts == f.ShortWriteAt:
+		if n, err = f.f.WriteAt(b[:len(b)/2], off); err != nil {
+			return
+		}
+
+		return n, f.fault("write")
+	case f.WriteAts == f.CorruptWriteAt && len(b) != 0:
+		c := make([]byte, len(b))
+		copy(c, b)
+		c[len(c)/2] ^= 0xff
+		b = c
+	}
+	return f.f.WriteAt(b, off)
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var newFaultFiler = func() Filer {
+	return NewFaultFiler(NewMemFiler())
+}
+
+func TestFaultFiler(t *testing.T) {
+	testFilerNesting(t, newFaultFiler)
+	testFilerTruncate(t, newFaultFiler)
+	testFilerReadAtWriteAt(t, newFaultFiler)
+	testInnerFiler(t, newFaultFiler)
+	testFileReadAtHole(t, newFaultFiler)
+}
+
+func TestFaultFilerFaults(t *testing.T) {
+	mf := NewMemFiler()
+	f := NewFaultFiler(mf)
+	f.FailWriteAt = 2
+	f.ShortWriteAt = 3
+	f.CorruptWriteAt = 4
+	f.FailSync = 2
+	f.FailTruncate = 1
+
+	b := []byte("0123456789")
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := f.WriteAt(b, 10); n != 0 || err == nil {
+		t.Fatal(n, err)
+	}
+
+	if n, err := f.WriteAt(b, 10); n != 5 || err == nil {
+		t.Fatal(n, err)
+	}
+
+	if n, err := f.WriteAt(b, 20); n != len(b) || err != nil {
+		t.Fatal(n, err)
+	}
+
+	if g, e := filerBytes(mf), []byte("012345678901234\x00\x00\x00\x00\x0001234\xca6789"); !bytes.Equal(g, e) {
+		t.Fatalf("\n%q\n%q", g, e)
+	}
+
+	if g, e := string(b), "0123456789"; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if sz, _ := f.Size(); sz != 30 {
+		t.Fatal(sz)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if g, e := f.Faults, 4; g != e {
+		t.Fatal(g, e)
+	}
+
+	f.Sticky = true
+	f.Err = errors.New("disk on fire")
+	if _, err := f.WriteAt(b, 0); err != f.Err {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(0); err != f.Err {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err != f.Err {
+		t.Fatal(err)
+	}
+}
+
+// Fail the DB writes of an ACIDFiler0 in the second phase of the commit and
+// check the transaction is recovered from the WAL.
+func TestFaultFilerACID(t *testing.T) {
+	const N = 1 << 10
+
+	dir, err := ioutil.TempDir("", "lldb-test-fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	walName := dir + "/wal"
+	wal, err := os.OpenFile(walName, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	db := NewMemFiler()
+	ff := NewFaultFiler(db)
+	f, err := NewACIDFiler(ff, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, h, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var k, v [8]byte
+	set := func(gen int) {
+		for i := 0; i < N; i++ {
+			binary.BigEndian.PutUint64(k[:], uint64(i))
+			binary.BigEndian.PutUint64(v[:], uint64(gen*N+i))
+			if err = tr.Set(k[:], v[:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	set(0)
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	set(1)
+	ff.FailWriteAt = ff.WriteAts + 2
+	ff.Sticky = true
+	if err = f.EndUpdate(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if ff.Faults == 0 {
+		t.Fatal("no fault injected")
+	}
+
+	// Reopen. The committed transaction is in the WAL.
+	wal2, err := os.OpenFile(walName, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal2.Close()
+
+	if f, err = NewACIDFiler(db, wal2); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = NewAllocator(f, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr, err = OpenBTree(a, nil, h); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(i))
+		binary.BigEndian.PutUint64(v[:], uint64(N+i))
+		g, err := tr.Get(nil, k[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(g, v[:]) {
+			t.Fatal(i, g, v)
+		}
+	}
+}
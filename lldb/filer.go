@@ -23,9 +23,11 @@ func doubleTrouble(first, second error) error {
 // are always "addressed" by an offset and are assumed to perform atomically.
 // A Filer is not safe for concurrent access, it's designed for consumption by
 // the other objects in package, which should use a Filer from one goroutine
-// only or via a mutex. BeginUpdate, EndUpdate and Rollback must be either all
-// implemented by a Filer for structural integrity - or they should be all
-// no-ops; where/if that requirement is relaxed.
+// only or via a mutex. The exception is ReadAt, which may be invoked by
+// multiple goroutines concurrently with each other. All Filers in this package
+// support that, Allocator.Get relies on it. BeginUpdate, EndUpdate and
+// Rollback must be either all implemented by a Filer for structural integrity
+// - or they should be all no-ops; where/if that requirement is relaxed.
 //
 // If a Filer wraps another Filer implementation, it usually invokes the same
 // methods on the "inner" one, after some possible argument translations etc.
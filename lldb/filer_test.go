@@ -658,6 +658,79 @@ func testFileReadAtHole(t *testing.T, nf newFunc) {
 	}
 }
 
+func TestFilerPunchHole(t *testing.T) {
+	testFilerPunchHole(t, newFileFiler)
+	testFilerPunchHole(t, newOSFileFiler)
+	testFilerPunchHole(t, newMemFiler)
+	testFilerPunchHole(t, nwBitFiler)
+	testFilerPunchHole(t, newRollbackFiler)
+}
+
+// Punching holes must not change the size nor the data outside of the holes.
+func testFilerPunchHole(t *testing.T, nf newFunc) {
+	const sz = 4*pgSize + 123
+
+	f := nf()
+	t.Log(f.Name())
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, ok := f.(*RollbackFiler); ok {
+		if err := f.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() {
+			if err := f.EndUpdate(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	b := make([]byte, sz)
+	for i := range b {
+		b[i] = byte(rng.Int())
+	}
+	if n, err := f.WriteAt(b, 0); n != len(b) {
+		t.Fatal(n, err)
+	}
+
+	hole := make([]bool, sz)
+	for _, v := range [][2]int64{
+		{0, pgSize + 1},
+		{3*pgSize - 100, pgSize + 200},
+		{5000, 100},
+		{sz - 10000, 10000},
+	} {
+		if err := f.PunchHole(v[0], v[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := v[0]; i < v[0]+v[1]; i++ {
+			hole[i] = true
+		}
+	}
+
+	if g, err := f.Size(); g != sz {
+		t.Fatal(g, err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f.ReadAt(g, 0); n != len(g) {
+		t.Fatal(n, err)
+	}
+
+	for i, v := range g {
+		if !hole[i] && v != b[i] {
+			t.Fatalf("%#x: %#02x %#02x", i, v, b[i])
+		}
+	}
+}
+
 func BenchmarkMemFilerWrSeq(b *testing.B) {
 	b.StopTimer()
 	buf := make([]byte, filerTestChunkSize)
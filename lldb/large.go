@@ -0,0 +1,251 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Large blocks.
+
+package lldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cznic/bufs"
+)
+
+const (
+	largeChunk     = 1 << 16         // Content bytes per chunk of a large block.
+	maxLargeChunks = (maxRq - 8) / 7 // Chunk handles fitting in an index block.
+)
+
+// AllocLarge allocates a large block with content read from r until io.EOF.
+// It returns the handle of the new large block or an error, if any. The
+// content of a large block is stored in as many blocks as needed, up to a
+// little more than 615MB. See the 'Large blocks' subtitle in the Allocator
+// documentation. The handle of a large block must be passed only to
+// GetLarge, ReallocLarge and FreeLarge.
+//
+// AllocLarge performs all of its allocations within a single
+// BeginUpdate/EndUpdate pair. The blocks allocated before an error are freed.
+func (a *Allocator) AllocLarge(r io.Reader) (handle int64, err error) {
+	if err = a.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	index, err := a.writeLarge(r)
+	if err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	if handle, err = a.Alloc(index); err != nil {
+		a.freeChunks(index)
+		a.f.Rollback()
+		return
+	}
+
+	return handle, a.f.EndUpdate()
+}
+
+// GetLarge writes the content of the large block handle to w. It returns the
+// number of bytes written and the first error encountered, if any.
+//
+// Handle must have been obtained initially from AllocLarge and must be still
+// valid, otherwise invalid data may be returned without detecting the error.
+//
+// GetLarge is safe for concurrent use by multiple goroutines, but not with
+// ReallocLarge or FreeLarge of the same handle.
+func (a *Allocator) GetLarge(w io.Writer, handle int64) (n int64, err error) {
+	size, chunks, err := a.largeIndex(handle)
+	if err != nil {
+		return
+	}
+
+	buf := bufs.GCache.Get(largeChunk)
+	defer bufs.GCache.Put(buf)
+	for i, h := range chunks {
+		var b []byte
+		if b, err = a.Get(buf, h); err != nil {
+			return
+		}
+
+		if rq := largeChunkLen(size, i); len(b) != rq {
+			return n, &ErrILSEQ{Type: ErrLargeIndex, Off: h2off(handle), More: fmt.Sprintf("chunk %d (handle %d) has size %d, expected %d", i, h, len(b), rq)}
+		}
+
+		nw, err := w.Write(b)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+// ReallocLarge sets the content of the large block handle to the content read
+// from r until io.EOF or returns an error, if any.
+//
+// The new content is written to new chunks before the former ones are freed,
+// within a single BeginUpdate/EndUpdate pair. After an error the large block
+// keeps its former content.
+//
+// Handle must have been obtained initially from AllocLarge and must be still
+// valid, otherwise a database may get irreparably corrupted.
+func (a *Allocator) ReallocLarge(handle int64, r io.Reader) (err error) {
+	old, err := a.Get(nil, handle)
+	if err != nil {
+		return
+	}
+
+	if _, _, err = parseLargeIndex(old, handle); err != nil {
+		return
+	}
+
+	if err = a.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	index, err := a.writeLarge(r)
+	if err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	if err = a.Realloc(handle, index); err != nil {
+		a.freeChunks(index)
+		a.f.Rollback()
+		return
+	}
+
+	if err = a.freeChunks(old); err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	return a.f.EndUpdate()
+}
+
+// FreeLarge deallocates the large block handle, ie. its index block and all of
+// its chunks, within a single BeginUpdate/EndUpdate pair.
+//
+// Handle must have been obtained initially from AllocLarge and must be still
+// valid, otherwise a database may get irreparably corrupted.
+func (a *Allocator) FreeLarge(handle int64) (err error) {
+	index, err := a.Get(nil, handle)
+	if err != nil {
+		return
+	}
+
+	if _, _, err = parseLargeIndex(index, handle); err != nil {
+		return
+	}
+
+	if err = a.f.BeginUpdate(); err != nil {
+		return
+	}
+
+	if err = a.freeChunks(index); err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	if err = a.Free(handle); err != nil {
+		a.f.Rollback()
+		return
+	}
+
+	return a.f.EndUpdate()
+}
+
+// writeLarge stores the content read from r in new chunks and returns the
+// content of their index block. The chunks are freed on error.
+func (a *Allocator) writeLarge(r io.Reader) (index []byte, err error) {
+	buf := bufs.GCache.Get(largeChunk)
+	defer bufs.GCache.Put(buf)
+	index = make([]byte, 8, 8+7*8)
+	var size int64
+	for eof := false; !eof; {
+		n, rerr := io.ReadFull(r, buf)
+		switch rerr {
+		case nil:
+			// nop
+		case io.EOF, io.ErrUnexpectedEOF:
+			eof = true
+		default:
+			err = rerr
+		}
+		if err == nil && n != 0 && len(index) == 8+7*maxLargeChunks {
+			err = &ErrINVAL{"Allocator: large block content too long", size + int64(n)}
+		}
+		if err != nil {
+			a.freeChunks(index)
+			return nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		h, err := a.Alloc(buf[:n])
+		if err != nil {
+			a.freeChunks(index)
+			return nil, err
+		}
+
+		var b [7]byte
+		index = append(index, h2b(b[:], h)...)
+		size += int64(n)
+	}
+	binary.BigEndian.PutUint64(index, uint64(size))
+	return
+}
+
+// freeChunks frees the chunks listed in index.
+func (a *Allocator) freeChunks(index []byte) (err error) {
+	for b := index[8:]; len(b) != 0; b = b[7:] {
+		if err = a.Free(b2h(b)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// largeIndex returns the content size and the chunk handles of the large
+// block handle.
+func (a *Allocator) largeIndex(handle int64) (size int64, chunks []int64, err error) {
+	index, err := a.Get(nil, handle)
+	if err != nil {
+		return
+	}
+
+	return parseLargeIndex(index, handle)
+}
+
+func parseLargeIndex(index []byte, handle int64) (size int64, chunks []int64, err error) {
+	if len(index) < 8 || (len(index)-8)%7 != 0 {
+		return 0, nil, &ErrILSEQ{Type: ErrLargeIndex, Off: h2off(handle), More: fmt.Sprintf("invalid index size %d", len(index))}
+	}
+
+	size = int64(binary.BigEndian.Uint64(index))
+	n := (len(index) - 8) / 7
+	if size < 0 || (size+largeChunk-1)/largeChunk != int64(n) {
+		return 0, nil, &ErrILSEQ{Type: ErrLargeIndex, Off: h2off(handle), More: fmt.Sprintf("content size %d in %d chunks", size, n)}
+	}
+
+	chunks = make([]int64, n)
+	for i := range chunks {
+		chunks[i] = b2h(index[8+7*i:])
+	}
+	return
+}
+
+// largeChunkLen returns the content length of chunk i of a large block of size
+// bytes.
+func largeChunkLen(size int64, i int) int {
+	if rem := size - int64(i)*largeChunk; rem < largeChunk {
+		return int(rem)
+	}
+
+	return largeChunk
+}
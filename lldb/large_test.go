@@ -0,0 +1,138 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+type errReader struct {
+	r io.Reader
+	n int // Bytes to read before failing.
+}
+
+func (r *errReader) Read(b []byte) (n int, err error) {
+	if r.n == 0 {
+		return 0, errors.New("errReader")
+	}
+
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+	n, err = r.r.Read(b)
+	r.n -= n
+	return
+}
+
+func TestAllocatorLarge(t *testing.T) {
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Compress = true
+	rng := rand.New(rand.NewSource(42))
+	content := func(n int) []byte {
+		b := rndBytes(rng, n)
+		for i := 0; i < n/2; i++ { // Make it compressible.
+			b[rng.Intn(n)] = 0
+		}
+		return b
+	}
+
+	check := func(h int64, e []byte) {
+		var buf bytes.Buffer
+		n, err := a.GetLarge(&buf, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := buf.Bytes(); n != int64(len(e)) || !bytes.Equal(g, e) {
+			t.Fatalf("handle %d: data mismatch, got %d bytes, expected %d", h, len(g), len(e))
+		}
+	}
+
+	sizes := []int{0, 1, largeChunk - 1, largeChunk, largeChunk + 1, 3*largeChunk + 17}
+	ref := map[int64][]byte{}
+	for _, n := range sizes {
+		b := content(n)
+		h, err := a.AllocLarge(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+		check(h, b)
+	}
+
+	for h := range ref {
+		b := content(sizes[rng.Intn(len(sizes))])
+		if err = a.ReallocLarge(h, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+	for h, b := range ref {
+		check(h, b)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing reader leaves no allocated blocks behind and the former
+	// content intact.
+	sz0, _ := f.Size()
+	if _, err = a.AllocLarge(&errReader{bytes.NewReader(content(3 * largeChunk)), 2*largeChunk + 1}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	for h := range ref {
+		if err = a.ReallocLarge(h, &errReader{bytes.NewReader(content(3 * largeChunk)), largeChunk + 1}); err == nil {
+			t.Fatal("unexpected success")
+		}
+	}
+	if sz, _ := f.Size(); sz != sz0 {
+		t.Fatal(sz, sz0)
+	}
+
+	for h, b := range ref {
+		check(h, b)
+	}
+
+	// A plain block is not a large block.
+	h, err := a.Alloc([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.GetLarge(ioutil.Discard, h); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrLargeIndex {
+		t.Fatalf("%T %v", err, err)
+	}
+
+	if err = a.Free(h); err != nil {
+		t.Fatal(err)
+	}
+
+	for h := range ref {
+		if err = a.FreeLarge(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sz, _ := f.Size(); sz != fltSz {
+		t.Fatal(sz)
+	}
+}
@@ -49,14 +49,16 @@
 // Also, as with memory pointers, dangling handles can be created and blocks
 // overwritten when such handles are used. Using a zero handle to refer to a
 // block will not panic; however, the resulting error is effectively the same
-// exceptional situation as dereferencing a nil pointer.
+// exceptional situation as dereferencing a nil pointer. The handle generations
+// mode of an Allocator detects most uses of dangling handles, see
+// Options.Generations.
 //
 // Blocks
 //
 // Allocated/used blocks, are limited in size to only a little bit more than
 // 64kB.  Bigger semantic entities/structures must be built in lldb's client
-// code.  The content of a block has no semantics attached, it's only a fully
-// opaque `[]byte`.
+// code or stored as large blocks, see Allocator.AllocLarge.  The content of a
+// block has no semantics attached, it's only a fully opaque `[]byte`.
 //
 // Scalars
 //
@@ -149,15 +149,8 @@ func (f *MemFiler) PunchHole(off, size int64) (err error) {
 		return &ErrINVAL{f.Name() + ": PunchHole size", size}
 	}
 
-	first := off >> pgBits
-	if off&pgMask != 0 {
-		first++
-	}
-	off += size - 1
-	last := off >> pgBits
-	if off&pgMask != 0 {
-		last--
-	}
+	first := (off + pgMask) >> pgBits
+	last := (off+size)>>pgBits - 1 // Last page completely inside the hole.
 	if limit := f.size >> pgBits; last > limit {
 		last = limit
 	}
@@ -257,6 +250,9 @@ func (f *MemFiler) Truncate(size int64) (err error) {
 		delete(f.m, first)
 	}
 
+	if pg := f.m[size>>pgBits]; pg != nil && size < f.size { // Zero the cut off part of the last page.
+		copy(pg[size&pgMask:], zeroPage[:])
+	}
 	f.size = size
 	return
 }
@@ -130,3 +130,31 @@ func TestMemFilerReadFromWriteTo(t *testing.T) {
 		t.Fatal(n0, n, d)
 	}
 }
+
+// Growing a truncated MemFiler must not resurrect the cut off content.
+func TestMemFilerTruncateGrow(t *testing.T) {
+	f := NewMemFiler()
+	b := bytes.Repeat([]byte{0xaa}, 3*pgSize)
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(100); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte{1}, int64(len(b))-1); err != nil {
+		t.Fatal(err)
+	}
+
+	g := filerBytes(f)
+	if len(g) != len(b) {
+		t.Fatal(len(g), len(b))
+	}
+
+	for i, v := range g[:len(g)-1] {
+		if i < 100 && v != 0xaa || i >= 100 && v != 0 {
+			t.Fatalf("%#x: %#x", i, v)
+		}
+	}
+}
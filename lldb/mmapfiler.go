@@ -0,0 +1,207 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+// A memory mapped os.File backed Filer.
+
+package lldb
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/cznic/mathutil"
+)
+
+var _ Filer = &MmapFiler{} // Ensure MmapFiler is a Filer.
+
+const mmapMaxGrow = 1 << 30 // Maximum mapping growth step above the requested size.
+
+// MmapFiler is an os.File backed Filer which accesses the file content through
+// a shared memory mapping instead of issuing a pread/pwrite system call for
+// every ReadAt/WriteAt. It is otherwise similar to a SimpleFileFiler, ie.
+// BeginUpdate, EndUpdate and Rollback only maintain the nesting counter. To
+// reach structural consistency wrap a MmapFiler in eg. a RollbackFiler or
+// ACIDFiler0.
+//
+// The mapping may be larger than the file. When WriteAt or Truncate grows the
+// file beyond the mapped area, a new, bigger mapping replaces the old one. The
+// mapping size grows geometrically to amortize the cost of remapping.
+//
+// MmapFiler is available only on Unix-like systems.
+type MmapFiler struct {
+	file *os.File
+	m    []byte // The mapping, len(m) is the mapped size.
+	nest int
+	size int64
+}
+
+// NewMmapFiler returns a new MmapFiler mapping f. The file must be opened for
+// both reading and writing.
+func NewMmapFiler(f *os.File) (r *MmapFiler, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	r = &MmapFiler{file: f, size: fi.Size()}
+	if err = r.remap(r.size); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// remap ensures the mapping covers at least need bytes.
+func (f *MmapFiler) remap(need int64) (err error) {
+	if need <= int64(len(f.m)) {
+		return
+	}
+
+	pg := int64(os.Getpagesize())
+	sz := need + mathutil.MinInt64(mathutil.MaxInt64(int64(len(f.m)), pg), mmapMaxGrow)
+	sz = (sz + pg - 1) &^ (pg - 1)
+	if sz != int64(int(sz)) {
+		return &ErrINVAL{f.Name() + ": mapping size out of limits", sz}
+	}
+
+	if err = f.unmap(); err != nil {
+		return
+	}
+
+	m, err := syscall.Mmap(int(f.file.Fd()), 0, int(sz), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+
+	f.m = m
+	return
+}
+
+func (f *MmapFiler) unmap() (err error) {
+	if f.m == nil {
+		return
+	}
+
+	m := f.m
+	f.m = nil
+	if err = syscall.Munmap(m); err != nil {
+		return os.NewSyscallError("munmap", err)
+	}
+
+	return
+}
+
+// BeginUpdate implements Filer.
+func (f *MmapFiler) BeginUpdate() error {
+	f.nest++
+	return nil
+}
+
+// Close implements Filer.
+func (f *MmapFiler) Close() (err error) {
+	if f.nest != 0 {
+		return &ErrPERM{(f.Name() + ":Close")}
+	}
+
+	if err = f.unmap(); err != nil {
+		return
+	}
+
+	return f.file.Close()
+}
+
+// EndUpdate implements Filer.
+func (f *MmapFiler) EndUpdate() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ":EndUpdate")}
+	}
+
+	f.nest--
+	return
+}
+
+// Name implements Filer.
+func (f *MmapFiler) Name() string {
+	return f.file.Name()
+}
+
+// PunchHole implements Filer. On Linux the space is deallocated using
+// fallocate(2), elsewhere PunchHole is a nop.
+func (f *MmapFiler) PunchHole(off, size int64) (err error) {
+	return punchHole(f.Name(), f.file.Fd(), off, size)
+}
+
+// ReadAt implements Filer.
+func (f *MmapFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":ReadAt invalid off", off}
+	}
+
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	if n = copy(b, f.m[off:f.size]); n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Rollback implements Filer.
+func (f *MmapFiler) Rollback() (err error) { return }
+
+// Size implements Filer.
+func (f *MmapFiler) Size() (int64, error) {
+	return f.size, nil
+}
+
+// Sync implements Filer.
+func (f *MmapFiler) Sync() (err error) {
+	if len(f.m) != 0 {
+		if _, _, errno := syscall.Syscall(
+			syscall.SYS_MSYNC,
+			uintptr(unsafe.Pointer(&f.m[0])),
+			uintptr(len(f.m)),
+			syscall.MS_SYNC,
+		); errno != 0 {
+			return os.NewSyscallError("msync", errno)
+		}
+	}
+
+	return f.file.Sync()
+}
+
+// Truncate implements Filer.
+func (f *MmapFiler) Truncate(size int64) (err error) {
+	if size < 0 {
+		return &ErrINVAL{"Truncate size", size}
+	}
+
+	if err = f.file.Truncate(size); err != nil {
+		return
+	}
+
+	f.size = size
+	return f.remap(size)
+}
+
+// WriteAt implements Filer.
+func (f *MmapFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ":WriteAt invalid off", off}
+	}
+
+	if end := off + int64(len(b)); end > f.size {
+		if err = f.Truncate(end); err != nil {
+			return
+		}
+	}
+
+	return copy(f.m[off:], b), nil
+}
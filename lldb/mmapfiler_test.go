@@ -0,0 +1,131 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+var newMmapFiler = func() Filer {
+	file, err := ioutil.TempFile("", "lldb-test-mmapfile")
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := NewMmapFiler(file)
+	if err != nil {
+		panic(err)
+	}
+
+	return &testFileFiler{f}
+}
+
+func TestMmapFiler(t *testing.T) {
+	testFilerNesting(t, newMmapFiler)
+	testFilerTruncate(t, newMmapFiler)
+	testFilerReadAtWriteAt(t, newMmapFiler)
+	testInnerFiler(t, newMmapFiler)
+	testFileReadAtHole(t, newMmapFiler)
+}
+
+func TestMmapFilerBTree(t *testing.T) {
+	const N = 1 << 12
+
+	file, err := ioutil.TempFile("", "lldb-test-mmapfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := file.Name()
+	defer os.Remove(name)
+
+	mf, err := NewMmapFiler(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewRollbackFiler(mf, func(sz int64) error { return mf.Truncate(sz) }, mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, h, err := CreateBTree(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var k, v [8]byte
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(rng.Int63()))
+		binary.BigEndian.PutUint64(v[:], uint64(i))
+		if err = tr.Set(k[:], v[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen using a plain file Filer and check the content.
+	if file, err = os.OpenFile(name, os.O_RDWR, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sf := NewSimpleFileFiler(file)
+	defer sf.Close()
+
+	if a, err = NewAllocator(sf, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr, err = OpenBTree(a, nil, h); err != nil {
+		t.Fatal(err)
+	}
+
+	rng.Seed(42)
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(rng.Int63()))
+		binary.BigEndian.PutUint64(v[:], uint64(i))
+		g, err := tr.Get(nil, k[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(g, v[:]) {
+			t.Fatal(i, g, v)
+		}
+	}
+}
@@ -74,8 +74,16 @@ func (f *OSFiler) Name() string {
 	return f.f.Name()
 }
 
-// PunchHole implements Filer.
+// PunchHole implements Filer. If the OSFile has a file descriptor, like an
+// *os.File, then on Linux the space is deallocated using fallocate(2).
+// Otherwise PunchHole is a nop.
 func (f *OSFiler) PunchHole(off, size int64) (err error) {
+	if x, ok := f.f.(interface {
+		Fd() uintptr
+	}); ok {
+		return punchHole(f.Name(), x.Fd(), off, size)
+	}
+
 	return
 }
 
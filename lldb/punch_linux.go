@@ -0,0 +1,45 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package lldb
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole deallocates the space of the file fd in the range [off, off+size)
+// using fallocate(2). File systems not supporting hole punching make it a nop.
+func punchHole(name string, fd uintptr, off, size int64) error {
+	if off < 0 {
+		return &ErrINVAL{name + ": PunchHole off", off}
+	}
+
+	if size < 0 {
+		return &ErrINVAL{name + ": PunchHole size", size}
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	for {
+		switch err := syscall.Fallocate(int(fd), fallocKeepSize|fallocPunchHole, off, size); err {
+		case nil, syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return nil
+		case syscall.EINTR:
+			// retry
+		default:
+			return &os.PathError{Op: "fallocate", Path: name, Err: err}
+		}
+	}
+}
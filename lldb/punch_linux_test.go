@@ -0,0 +1,90 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package lldb
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func fileBlocks(t *testing.T, f *os.File) int64 {
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+
+	return st.Blocks
+}
+
+func TestAllocatorPunchHole(t *testing.T) {
+	file, err := ioutil.TempFile("", "lldb-test-punch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	f := NewSimpleFileFiler(file)
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, maxRq)
+	for i := range b {
+		b[i] = byte(i | 1)
+	}
+	var h [3]int64
+	for i := range h {
+		if h[i], err = a.Alloc(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := fileBlocks(t, file)
+	if err = a.Free(h[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fileBlocks(t, file), blocks-(maxRq-2*punchSize)/512; g > e {
+		t.Fatalf("got %d blocks, expected at most %d", g, e)
+	}
+
+	if g, err := f.Size(); g != sz {
+		t.Fatal(g, sz, err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []int64{h[0], h[2]} {
+		g, err := a.Get(nil, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(g) != string(b) {
+			t.Fatal("data mismatch")
+		}
+	}
+}
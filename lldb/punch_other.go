@@ -0,0 +1,21 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package lldb
+
+// punchHole is a nop on this platform.
+func punchHole(name string, fd uintptr, off, size int64) error {
+	if off < 0 {
+		return &ErrINVAL{name + ": PunchHole off", off}
+	}
+
+	if size < 0 {
+		return &ErrINVAL{name + ": PunchHole size", size}
+	}
+
+	return nil
+}
@@ -9,7 +9,6 @@ package lldb
 import (
 	"os"
 
-	"github.com/cznic/fileutil"
 	"github.com/cznic/mathutil"
 )
 
@@ -67,9 +66,10 @@ func (f *SimpleFileFiler) Name() string {
 	return f.file.Name()
 }
 
-// PunchHole implements Filer.
+// PunchHole implements Filer. On Linux the space is deallocated using
+// fallocate(2), elsewhere PunchHole is a nop.
 func (f *SimpleFileFiler) PunchHole(off, size int64) (err error) {
-	return fileutil.PunchHole(f.file, off, size)
+	return punchHole(f.Name(), f.file.Fd(), off, size)
 }
 
 // ReadAt implements Filer.
@@ -96,6 +96,9 @@ type (
 		parent Filer
 		m      bitFilerMap
 		size   int64
+		psize  int64      // Parent size.
+		trunc  int64      // Minimum size since created.
+		holes  [][2]int64 // Punched holes, {off, size}.
 	}
 )
 
@@ -105,7 +108,56 @@ func newBitFiler(parent Filer) (f *bitFiler, err error) {
 		return
 	}
 
-	return &bitFiler{parent: parent, m: bitFilerMap{}, size: sz}, nil
+	return &bitFiler{parent: parent, m: bitFilerMap{}, size: sz, psize: sz, trunc: sz}, nil
+}
+
+// page returns page pgI, reading it from the parent if not yet loaded. Any
+// part of the page truncated off since f was created reads as zeros and it is
+// marked dirty if the parent has it, so the old content cannot reappear in the
+// parent when the file grows again.
+func (f *bitFiler) page(pgI int64) (pg *bitPage, err error) {
+	if pg = f.m[pgI]; pg != nil {
+		return
+	}
+
+	pg = &bitPage{}
+	off := pgI << bfBits
+	if n := f.trunc - off; f.parent != nil && n > 0 {
+		if _, err = f.parent.ReadAt(pg.data[:mathutil.MinInt64(n, bfSize)], off); err != nil && !fileutil.IsEOF(err) {
+			return nil, err
+		}
+
+		err = nil
+	}
+	f.m[pgI] = pg
+	f.dirtyTail(pg, off, mathutil.MaxInt64(f.trunc, off))
+	return
+}
+
+// peek reads b at off, which must be within a single page not yet loaded,
+// like page would read it. It does not load the page, so ReadAt does not
+// modify f and it is safe for concurrent use.
+func (f *bitFiler) peek(b []byte, off int64) (err error) {
+	var n int
+	if f.parent != nil && off < f.trunc {
+		if n, err = f.parent.ReadAt(b[:mathutil.MinInt64(int64(len(b)), f.trunc-off)], off); err != nil && !fileutil.IsEOF(err) {
+			return
+		}
+	}
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	return nil
+}
+
+// dirtyTail marks dirty the bytes of page pg, starting at off, in [from,
+// f.psize).
+func (f *bitFiler) dirtyTail(pg *bitPage, off, from int64) {
+	to := mathutil.MinInt64(f.psize, off+bfSize)
+	for i := int(from - off); i < int(to-off); i++ {
+		pg.flags[i>>3] |= bitmask[i&7]
+		pg.dirty = true
+	}
 }
 
 func (f *bitFiler) BeginUpdate() error { panic("internal error") }
@@ -118,23 +170,22 @@ func (f *bitFiler) Name() string         { return fmt.Sprintf("%p.bitfiler", f)
 func (f *bitFiler) Size() (int64, error) { return f.size, nil }
 
 func (f *bitFiler) PunchHole(off, size int64) (err error) {
-	first := off >> bfBits
-	if off&bfMask != 0 {
-		first++
-	}
-	off += size - 1
-	last := off >> bfBits
-	if off&bfMask != 0 {
-		last--
-	}
+	first := (off + bfMask) >> bfBits
+	last := (off+size)>>bfBits - 1 // Last page completely inside the hole.
 	if limit := f.size >> bfBits; last > limit {
 		last = limit
 	}
+	if first > last {
+		return
+	}
+
 	for pgI := first; pgI <= last; pgI++ {
 		pg := &bitPage{}
 		pg.flags = allDirtyFlags
+		pg.dirty = true
 		f.m[pgI] = pg
 	}
+	f.holes = append(f.holes, [2]int64{first << bfBits, (last - first + 1) << bfBits})
 	return
 }
 
@@ -148,20 +199,15 @@ func (f *bitFiler) ReadAt(b []byte, off int64) (n int, err error) {
 		err = io.EOF
 	}
 	for rem != 0 && avail > 0 {
-		pg := f.m[pgI]
-		if pg == nil {
-			pg = &bitPage{}
-			if f.parent != nil {
-				_, err = f.parent.ReadAt(pg.data[:], off&^bfMask)
-				if err != nil && !fileutil.IsEOF(err) {
-					return
-				}
-
-				err = nil
+		nc := mathutil.Min(rem, bfSize-pgO)
+		switch pg := f.m[pgI]; {
+		case pg != nil:
+			copy(b[:nc], pg.data[pgO:])
+		default:
+			if err := f.peek(b[:nc], off); err != nil {
+				return n, err
 			}
-			f.m[pgI] = pg
 		}
-		nc := copy(b[:mathutil.Min(rem, bfSize)], pg.data[pgO:])
 		pgI++
 		pgO = 0
 		rem -= nc
@@ -179,9 +225,11 @@ func (f *bitFiler) Truncate(size int64) (err error) {
 	case size == 0:
 		f.m = bitFilerMap{}
 		f.size = 0
+		f.trunc = 0
 		return
 	}
 
+	f.trunc = mathutil.MinInt64(f.trunc, size)
 	first := size >> bfBits
 	if size&bfMask != 0 {
 		first++
@@ -194,6 +242,12 @@ func (f *bitFiler) Truncate(size int64) (err error) {
 		delete(f.m, first)
 	}
 
+	if pg := f.m[size>>bfBits]; pg != nil && size < f.size {
+		// Zero the cut off part of the last page.
+		off := size &^ bfMask
+		copy(pg.data[size-off:], bitZeroPage.data[:])
+		f.dirtyTail(pg, off, size)
+	}
 	f.size = size
 	return
 }
@@ -206,19 +260,11 @@ func (f *bitFiler) WriteAt(b []byte, off int64) (n int, err error) {
 	rem := n
 	var nc int
 	for rem != 0 {
-		pg := f.m[pgI]
-		if pg == nil {
-			pg = &bitPage{}
-			if f.parent != nil {
-				_, err = f.parent.ReadAt(pg.data[:], off&^bfMask)
-				if err != nil && !fileutil.IsEOF(err) {
-					return
-				}
-
-				err = nil
-			}
-			f.m[pgI] = pg
+		pg, err := f.page(pgI)
+		if err != nil {
+			return 0, err
 		}
+
 		nc = copy(pg.data[pgO:], b)
 		pgI++
 		pg.dirty = true
@@ -246,6 +292,14 @@ func (f *bitFiler) link() {
 }
 
 func (f *bitFiler) dumpDirty(w io.WriterAt) (nwr int, err error) {
+	// Loading the pages truncated off in the parent, and not written since,
+	// marks them dirty, so the old content cannot reappear.
+	for pgI, to := f.trunc>>bfBits, mathutil.MinInt64(f.size, f.psize); pgI<<bfBits < to; pgI++ {
+		if _, err = f.page(pgI); err != nil {
+			return
+		}
+	}
+
 	f.link()
 	for pgI, pg := range f.m {
 		if !pg.dirty {
@@ -332,7 +386,9 @@ func (f *bitFiler) dumpDirty(w io.WriterAt) (nwr int, err error) {
 // used by the client.
 //
 // The "real" writes to the wrapped Filer (or WAL instead) go through the
-// writerAt supplied to NewRollbackFiler.
+// writerAt supplied to NewRollbackFiler. Holes punched within a transaction
+// are written as zeros and, after a successful checkpoint, punched also in
+// the wrapped Filer.
 //
 // List of functions/methods which are recommended to be wrapped in a
 // BeginUpdate/EndUpdate structural transaction:
@@ -502,14 +558,47 @@ func (r *RollbackFiler) EndUpdate() (err error) {
 			return
 		}
 
-		return r.checkpoint(sz)
+		if err = r.checkpoint(sz); err != nil {
+			return
+		}
+
+		return r.punchHoles(bf, sz)
 	default:
 		r.bitFiler = parent.(*bitFiler)
+		r.bitFiler.holes = append(r.bitFiler.holes, bf.holes...)
 		sz, _ := bf.Size() // bitFiler.Size() never returns err != nil
 		return parent.Truncate(sz)
 	}
 }
 
+// punchHoles punches the holes of a committed transaction in the wrapped
+// Filer. Only the pages which are still zero filled at the end of the
+// transaction are punched, the zeros were already written by writerAt.
+func (r *RollbackFiler) punchHoles(bf *bitFiler, sz int64) (err error) {
+	for _, v := range bf.holes {
+		first, n := v[0]>>bfBits, v[1]>>bfBits
+		var off, size int64
+		for pgI := first; pgI <= first+n; pgI++ {
+			if pg := bf.m[pgI]; pgI < first+n && pgI<<bfBits+bfSize <= sz && pg != nil && pg.data == bitZeroPage.data {
+				if size == 0 {
+					off = pgI << bfBits
+				}
+				size += bfSize
+				continue
+			}
+
+			if size != 0 {
+				if err = r.f.PunchHole(off, size); err != nil {
+					return
+				}
+
+				size = 0
+			}
+		}
+	}
+	return
+}
+
 // Implements Filer.
 func (r *RollbackFiler) Name() string {
 	r.mu.RLock()
@@ -361,6 +361,69 @@ func TestRollbackFiler4(t *testing.T) {
 	}
 }
 
+// Holes are punched in the wrapped Filer only where not overwritten later in
+// the same transaction.
+func TestRollbackFilerPunchHole(t *testing.T) {
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	b := rndBytes(rng, 8*bfSize)
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.PunchHole(bfSize, 6*bfSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt(b[3*bfSize+10:3*bfSize+20], 3*bfSize+10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := filerBytes(f)
+	if len(g) != len(b) {
+		t.Fatal(len(g), len(b))
+	}
+
+	for i, v := range g {
+		e := b[i]
+		if i >= bfSize && i < 7*bfSize && (i < 3*bfSize+10 || i >= 3*bfSize+20) {
+			e = 0
+		}
+		if v != e {
+			t.Fatalf("%#x: %#02x %#02x", i, v, e)
+		}
+	}
+}
+
 func BenchmarkRollbackFiler(b *testing.B) {
 	rng := rand.New(rand.NewSource(42))
 	type t struct {
@@ -398,3 +461,74 @@ func BenchmarkRollbackFiler(b *testing.B) {
 		}
 	}
 }
+
+// Growing a file truncated within a transaction must not resurrect the cut
+// off content, neither in the transaction nor in the wrapped Filer.
+func TestRollbackFilerTruncateGrow(t *testing.T) {
+	const sz = 8 * bfSize
+
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := bytes.Repeat([]byte{0xaa}, sz)
+	if _, err = f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(g []byte, cut int) {
+		if len(g) != sz {
+			t.Fatal(len(g), sz)
+		}
+
+		for i, v := range g[:sz-1] {
+			if i < cut && v != 0xaa || i >= cut && v != 0 {
+				t.Fatalf("%#x: %#x", i, v)
+			}
+		}
+	}
+
+	for _, cut := range []int{3*bfSize + 100, 2 * bfSize, 100, 0} {
+		if err = r.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Load some of the pages before truncating.
+		if _, err = r.ReadAt(make([]byte, 10), int64(cut)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = r.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = r.Truncate(int64(cut)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = r.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = r.WriteAt([]byte{1}, sz-1); err != nil {
+			t.Fatal(err)
+		}
+
+		g := make([]byte, sz)
+		if n, err := r.ReadAt(g, 0); n != sz {
+			t.Fatal(n, err)
+		}
+
+		check(g, cut)
+		if err = r.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(filerBytes(f), cut)
+		if _, err = f.WriteAt(b, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}